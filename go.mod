@@ -4,16 +4,20 @@ go 1.13
 
 require (
 	github.com/BurntSushi/toml v0.3.1
+	github.com/blang/semver v3.5.0+incompatible // indirect
 	github.com/containers/image v3.0.2+incompatible
+	github.com/evanphx/json-patch v4.2.0+incompatible
 	github.com/openshift/api v3.9.1-0.20191028134408-abf28f93703b+incompatible
 	github.com/openshift/client-go v0.0.0-20191022152013-2823239d2298
 	github.com/openshift/library-go v0.0.0-20191029093732-d368763acf52
 	github.com/openshift/oc v4.2.0-alpha.0+incompatible
 	github.com/openshift/runtime-utils v0.0.0-20191011150825-9169de69ebf6
 	github.com/spf13/cobra v0.0.5
+	github.com/spf13/pflag v1.0.5
+	golang.org/x/net v0.0.0-20191004110552-13f9640d40b9
 	k8s.io/api v0.0.0-20191122220107-b5267f2975e0
 	k8s.io/apimachinery v0.0.0-20191121175448-79c2a76c473a
 	k8s.io/cli-runtime v0.0.0-20191122222818-9150eb3ded31
 	k8s.io/client-go v0.0.0-20191122220542-ed16ecbdf3a0
-	k8s.io/kubectl v0.0.0-20191122225023-1e3c8b70f494
+	sigs.k8s.io/yaml v1.1.0
 )
@@ -1,24 +1,102 @@
 package api
 
+import (
+	"time"
+
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
 type Config struct {
-	Kubeconfig string
+	// the standard kubeconfig flags (--kubeconfig, --context, -n, etc.) shared by all of the verbs
+	ConfigFlags *genericclioptions.ConfigFlags
+
+	// offline mode, where manifests on disk are used instead of a live cluster
+	FromDir   string
+	FromFiles []string
 
 	// imagestream translate specific
-	OverrideLocal bool
-	SHA bool
+	OverrideLocal  bool
+	SHA            bool
+	ResolveMirrors bool
+	ProbeMirrors   bool
+	Kind           string
+	FromReference  string
+	ResolveDigest  bool
+	Explain        bool
+	Import         bool
+	ImportFrom     string
+	ImportTimeout  time.Duration
+	Watch          bool
+	WatchResync    time.Duration
 
 	// proxy config specific
-	HttpProxyOnly bool
+	HttpProxyOnly  bool
 	HttpsProxyOnly bool
-	NoProxyOnly bool
-	ENVVarsOnly bool
+	NoProxyOnly    bool
+	ENVVarsOnly    bool
+	BuildConfig    string
 
 	// both proxy and image registry
 	CADataOnly bool
 
 	// image registry
-	DockerConfigFile bool
+	DockerConfigFile    bool
+	BuildTool           string
+	Install             bool
+	AuthProperties      bool
+	ServiceAccount      string
+	RegistryHost        string
+	Secret              string
+	UseToken            bool
+	TokenServiceAccount string
+	TokenExpiration     time.Duration
+	Redact              bool
+
+	// build provenance
+	BaseImages      []string
+	GitURL          string
+	GitCommit       string
+	PipelineRun     string
+	BuilderID       string
+	BuildFinishedOn string
+
+	// auth
+	RBACServiceAccount string
+	RBACRoleName       string
+
+	// tekton task generation
+	TaskImage     string
+	TaskVersion   string
+	TaskOutputDir string
+
+	// build environment snapshots
+	SnapshotNamespaces []string
+
+	// s2i
+	S2IContextDir  string
+	S2ISourceDir   string
+	S2IEnv         []string
+	S2IScriptsURL  string
+	RegistriesConf string
+
+	// build config translation
+	BuildArgsOutput string
+	PullSecretFile  string
+	InjectDir       string
+	Cleanup         bool
+	SourceSecret    string
+	GitConfigDir    string
+
+	// webhook
+	WebhookPort     int
+	TLSCertFile     string
+	TLSKeyFile      string
+	WebhookSelector string
 
-	Namespace string
+	// controller
+	AllNamespaces bool
+	LeaderElect   bool
+	Debounce      time.Duration
 
+	OutputFile string
 }
@@ -4,6 +4,7 @@ import (
 	"github.com/gabemontero/obu/pkg/api"
 	"github.com/gabemontero/obu/pkg/cmd/cli/cmd"
 	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
 )
 
 func NewCmdCLI() *cobra.Command {
@@ -17,16 +18,35 @@ func NewCmdCLI() *cobra.Command {
 		},
 	}
 
-	obu.PersistentFlags().StringVar(&(cfg.Kubeconfig), "kubeconfig", cfg.Kubeconfig,
-		"Path to the kubeconfig file to use for CLI requests.")
+	cfg.ConfigFlags = genericclioptions.NewConfigFlags(true)
+	// unlike oc, bound API server requests by default, as a hung step would otherwise hang the whole pipeline run
+	requestTimeout := "1m"
+	cfg.ConfigFlags.Timeout = &requestTimeout
+	cfg.ConfigFlags.AddFlags(obu.PersistentFlags())
+	obu.PersistentFlags().StringVar(&(cfg.FromDir), "from-dir", cfg.FromDir,
+		"Run offline against the YAML/JSON manifests found under this directory (i.e. a must-gather) instead of a live cluster.")
+	obu.PersistentFlags().StringSliceVar(&(cfg.FromFiles), "from-file", cfg.FromFiles,
+		"Run offline against the YAML/JSON manifests in this file (i.e. 'oc get -o yaml' output) instead of a live cluster.  Can be repeated.")
 	obu.AddCommand(cmd.NewCmdTranslateIST(cfg))
 	obu.AddCommand(cmd.NewCmdGlobalProxyConfig(cfg))
 	obu.AddCommand(cmd.NewCmdInternalRegistry(cfg))
 	obu.AddCommand(cmd.NewCmdMirrorRegistryConf(cfg))
+	obu.AddCommand(cmd.NewCmdController(cfg))
+	obu.AddCommand(cmd.NewCmdAnnotateProvenance(cfg))
+	obu.AddCommand(cmd.NewCmdAuth(cfg))
+	obu.AddCommand(cmd.NewCmdTekton(cfg))
+	obu.AddCommand(cmd.NewCmdWebhook(cfg))
+	obu.AddCommand(cmd.NewCmdSync(cfg))
+	obu.AddCommand(cmd.NewCmdSnapshot(cfg))
+	obu.AddCommand(cmd.NewCmdDiff(cfg))
+	obu.AddCommand(cmd.NewCmdS2I(cfg))
+	obu.AddCommand(cmd.NewCmdBuildArgs(cfg))
+	obu.AddCommand(cmd.NewCmdInject(cfg))
+	obu.AddCommand(cmd.NewCmdGitCloneConfig(cfg))
 
 	return obu
 }
 
 func CommandFor() *cobra.Command {
 	return NewCmdCLI()
-}
\ No newline at end of file
+}
@@ -0,0 +1,435 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+	"github.com/spf13/cobra"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// accessRule is one API call an obu verb makes.  Rules with an empty namespace are made in the namespace obu is
+// run against, unless they are for cluster scoped resources or made across all namespaces, which both need a
+// ClusterRole.
+type accessRule struct {
+	verb          string
+	group         string
+	resource      string
+	name          string
+	namespace     string
+	clusterScoped bool
+	// the option that leads to the call, when it is not always made
+	when string
+}
+
+// obuVerbAccess lists the API calls each obu verb makes, which has to be kept in sync with the verbs themselves
+var obuVerbAccess = map[string][]accessRule{
+	"translate": {
+		{verb: "get", group: "image.openshift.io", resource: "imagestreams"},
+		{verb: "create", group: "image.openshift.io", resource: "imagestreamimports", when: "--import"},
+		{verb: "list", group: "image.openshift.io", resource: "imagestreams", when: "--watch"},
+		{verb: "watch", group: "image.openshift.io", resource: "imagestreams", when: "--watch"},
+		{verb: "list", group: "operator.openshift.io", resource: "imagecontentsourcepolicies", clusterScoped: true, when: "--resolve-mirrors"},
+	},
+	"proxy": {
+		{verb: "get", group: "config.openshift.io", resource: "proxies", name: "cluster", clusterScoped: true},
+		{verb: "get", group: "config.openshift.io", resource: "builds", name: "cluster", clusterScoped: true},
+		{verb: "get", group: "build.openshift.io", resource: "buildconfigs", when: "--build-config"},
+		{verb: "get", resource: "configmaps", name: "openshift-global-ca", namespace: "openshift-controller-manager"},
+	},
+	"registry": {
+		{verb: "get", resource: "configmaps", name: "serviceca", namespace: "openshift-image-registry"},
+		{verb: "get", resource: "serviceaccounts"},
+		{verb: "get", resource: "secrets"},
+		{verb: "get", group: "config.openshift.io", resource: "images", name: "cluster", clusterScoped: true},
+		{verb: "list", group: "image.openshift.io", resource: "imagestreams"},
+		{verb: "create", resource: "serviceaccounts/token", when: "--token-service-account"},
+		{verb: "list", group: "operator.openshift.io", resource: "imagecontentsourcepolicies", clusterScoped: true, when: "--install"},
+	},
+	"mirror": {
+		{verb: "get", group: "config.openshift.io", resource: "images", name: "cluster", clusterScoped: true},
+		{verb: "get", resource: "configmaps", namespace: "openshift-config"},
+		{verb: "list", group: "operator.openshift.io", resource: "imagecontentsourcepolicies", clusterScoped: true},
+	},
+	"controller": {
+		{verb: "list", group: "image.openshift.io", resource: "imagestreams"},
+		{verb: "watch", group: "image.openshift.io", resource: "imagestreams"},
+		{verb: "get", group: "image.openshift.io", resource: "imagestreams"},
+		{verb: "update", group: "image.openshift.io", resource: "imagestreams"},
+		{verb: "get", resource: "configmaps"},
+		{verb: "create", group: "tekton.dev", resource: "pipelineruns"},
+		{verb: "create", resource: "configmaps", when: "--leader-elect"},
+		{verb: "update", resource: "configmaps", when: "--leader-elect"},
+		{verb: "list", group: "image.openshift.io", resource: "imagestreams", clusterScoped: true, when: "--all-namespaces"},
+		{verb: "watch", group: "image.openshift.io", resource: "imagestreams", clusterScoped: true, when: "--all-namespaces"},
+		{verb: "get", group: "image.openshift.io", resource: "imagestreams", clusterScoped: true, when: "--all-namespaces"},
+		{verb: "update", group: "image.openshift.io", resource: "imagestreams", clusterScoped: true, when: "--all-namespaces"},
+		{verb: "get", resource: "configmaps", clusterScoped: true, when: "--all-namespaces"},
+		{verb: "create", group: "tekton.dev", resource: "pipelineruns", clusterScoped: true, when: "--all-namespaces"},
+	},
+	"webhook": {
+		{verb: "get", group: "config.openshift.io", resource: "proxies", name: "cluster", clusterScoped: true},
+		{verb: "get", group: "config.openshift.io", resource: "builds", name: "cluster", clusterScoped: true},
+		{verb: "get", group: "config.openshift.io", resource: "images", name: "cluster", clusterScoped: true},
+		{verb: "list", group: "operator.openshift.io", resource: "imagecontentsourcepolicies", clusterScoped: true},
+		{verb: "get", resource: "configmaps", name: "openshift-global-ca", namespace: "openshift-controller-manager"},
+		{verb: "get", resource: "configmaps", name: "serviceca", namespace: "openshift-image-registry"},
+		{verb: "get", resource: "configmaps", namespace: "openshift-config"},
+		// the pods of TaskRuns in every namespace are admitted
+		{verb: "list", group: "image.openshift.io", resource: "imagestreams", clusterScoped: true},
+		{verb: "get", resource: "serviceaccounts", clusterScoped: true},
+		{verb: "get", resource: "secrets", clusterScoped: true},
+		{verb: "get", resource: "configmaps", clusterScoped: true},
+		{verb: "create", resource: "configmaps", clusterScoped: true},
+		{verb: "update", resource: "configmaps", clusterScoped: true},
+		{verb: "create", resource: "secrets", clusterScoped: true},
+		{verb: "update", resource: "secrets", clusterScoped: true},
+	},
+	"sync": {
+		{verb: "get", group: "config.openshift.io", resource: "proxies", name: "cluster", clusterScoped: true},
+		{verb: "get", group: "config.openshift.io", resource: "builds", name: "cluster", clusterScoped: true},
+		{verb: "get", group: "config.openshift.io", resource: "images", name: "cluster", clusterScoped: true},
+		{verb: "list", group: "operator.openshift.io", resource: "imagecontentsourcepolicies", clusterScoped: true},
+		{verb: "get", resource: "configmaps", name: "openshift-global-ca", namespace: "openshift-controller-manager"},
+		{verb: "get", resource: "configmaps", name: "serviceca", namespace: "openshift-image-registry"},
+		{verb: "get", resource: "configmaps", namespace: "openshift-config"},
+		{verb: "list", group: "image.openshift.io", resource: "imagestreams"},
+		{verb: "get", resource: "serviceaccounts"},
+		{verb: "get", resource: "secrets"},
+		{verb: "get", resource: "configmaps"},
+		{verb: "create", resource: "configmaps"},
+		{verb: "update", resource: "configmaps"},
+		{verb: "create", resource: "secrets"},
+		{verb: "update", resource: "secrets"},
+		{verb: "list", group: "config.openshift.io", resource: "proxies", clusterScoped: true, when: "--watch"},
+		{verb: "watch", group: "config.openshift.io", resource: "proxies", clusterScoped: true, when: "--watch"},
+		{verb: "list", group: "config.openshift.io", resource: "images", clusterScoped: true, when: "--watch"},
+		{verb: "watch", group: "config.openshift.io", resource: "images", clusterScoped: true, when: "--watch"},
+		{verb: "list", group: "config.openshift.io", resource: "builds", clusterScoped: true, when: "--watch"},
+		{verb: "watch", group: "config.openshift.io", resource: "builds", clusterScoped: true, when: "--watch"},
+		{verb: "watch", group: "operator.openshift.io", resource: "imagecontentsourcepolicies", clusterScoped: true, when: "--watch"},
+	},
+	"snapshot": {
+		{verb: "get", group: "config.openshift.io", resource: "proxies", name: "cluster", clusterScoped: true},
+		{verb: "get", group: "config.openshift.io", resource: "builds", name: "cluster", clusterScoped: true},
+		{verb: "get", group: "config.openshift.io", resource: "images", name: "cluster", clusterScoped: true},
+		{verb: "list", group: "operator.openshift.io", resource: "imagecontentsourcepolicies", clusterScoped: true},
+		{verb: "get", resource: "configmaps", name: "openshift-global-ca", namespace: "openshift-controller-manager"},
+		{verb: "get", resource: "configmaps", name: "serviceca", namespace: "openshift-image-registry"},
+		{verb: "get", resource: "configmaps", namespace: "openshift-config"},
+		{verb: "list", group: "image.openshift.io", resource: "imagestreams"},
+		{verb: "get", resource: "serviceaccounts"},
+		{verb: "get", resource: "secrets"},
+	},
+	"diff": {
+		{verb: "get", group: "config.openshift.io", resource: "proxies", name: "cluster", clusterScoped: true, when: "a single snapshot"},
+		{verb: "get", group: "config.openshift.io", resource: "builds", name: "cluster", clusterScoped: true, when: "a single snapshot"},
+		{verb: "get", group: "config.openshift.io", resource: "images", name: "cluster", clusterScoped: true, when: "a single snapshot"},
+		{verb: "list", group: "operator.openshift.io", resource: "imagecontentsourcepolicies", clusterScoped: true, when: "a single snapshot"},
+		{verb: "get", resource: "configmaps", name: "openshift-global-ca", namespace: "openshift-controller-manager", when: "a single snapshot"},
+		{verb: "get", resource: "configmaps", name: "serviceca", namespace: "openshift-image-registry", when: "a single snapshot"},
+		{verb: "get", resource: "configmaps", namespace: "openshift-config", when: "a single snapshot"},
+		{verb: "list", group: "image.openshift.io", resource: "imagestreams", when: "a single snapshot"},
+		{verb: "get", resource: "serviceaccounts", when: "a single snapshot"},
+		{verb: "get", resource: "secrets", when: "a single snapshot"},
+	},
+	"s2i": {
+		{verb: "get", group: "image.openshift.io", resource: "imagestreams"},
+		{verb: "get", resource: "serviceaccounts"},
+		{verb: "get", resource: "secrets"},
+		{verb: "get", resource: "configmaps", name: "serviceca", namespace: "openshift-image-registry"},
+		{verb: "get", group: "config.openshift.io", resource: "images", name: "cluster", clusterScoped: true},
+		{verb: "list", group: "operator.openshift.io", resource: "imagecontentsourcepolicies", clusterScoped: true, when: "no --registries-conf"},
+		{verb: "get", resource: "configmaps", namespace: "openshift-config"},
+	},
+	"buildargs": {
+		{verb: "get", group: "build.openshift.io", resource: "buildconfigs"},
+		{verb: "get", resource: "configmaps"},
+		{verb: "get", resource: "secrets"},
+		{verb: "get", group: "image.openshift.io", resource: "imagestreams"},
+	},
+	"inject": {
+		{verb: "get", group: "build.openshift.io", resource: "buildconfigs"},
+		{verb: "get", resource: "configmaps"},
+		{verb: "get", resource: "secrets"},
+	},
+	"git-clone-config": {
+		{verb: "get", group: "build.openshift.io", resource: "buildconfigs", when: "a build config is given"},
+		{verb: "get", resource: "secrets", when: "there is a source secret"},
+		{verb: "get", group: "config.openshift.io", resource: "proxies", name: "cluster", clusterScoped: true},
+		{verb: "get", group: "config.openshift.io", resource: "builds", name: "cluster", clusterScoped: true},
+		{verb: "get", resource: "configmaps", name: "openshift-global-ca", namespace: "openshift-controller-manager"},
+	},
+	"annotate-provenance": {
+		{verb: "get", group: "image.openshift.io", resource: "imagestreamtags"},
+		{verb: "update", group: "image.openshift.io", resource: "imagestreamtags"},
+		{verb: "get", group: "image.openshift.io", resource: "imagestreams"},
+		{verb: "get", group: "config.openshift.io", resource: "proxies", name: "cluster", clusterScoped: true},
+		{verb: "list", group: "operator.openshift.io", resource: "imagecontentsourcepolicies", clusterScoped: true},
+	},
+}
+
+func NewCmdAuth(cfg *api.Config) *cobra.Command {
+	authCmd := &cobra.Command{
+		Use:   "auth",
+		Short: "Inspect the authorization obu needs.",
+		Long:  "Inspect the authorization the obu verbs need against the cluster.",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+	authCmd.AddCommand(NewCmdAuthCanI(cfg))
+	return authCmd
+}
+
+func NewCmdAuthCanI(cfg *api.Config) *cobra.Command {
+	canICmd := &cobra.Command{
+		Use:   "can-i [<obu verb>...] [<options>]",
+		Short: "Check whether the obu verbs are allowed to make the API calls they need.",
+		Long: "Check, with self subject access reviews, whether the current user can make each of the API calls the obu\n" +
+			"verbs need, or emit the RBAC to allow a service account to make them.  All verbs are covered when none are given.",
+		Example: `
+# Check whether the current user, i.e. the service account of a Tekton step, can run each of the obu verbs
+$ obu auth can-i
+
+# Check only the registry and mirror verbs
+$ obu auth can-i registry mirror
+
+# Emit the Roles, ClusterRole and bindings that allow the pipeline service account to run the proxy verb
+$ obu auth can-i proxy --service-account pipeline | oc apply -f -
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			verbs, err := getObuVerbs(args)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			namespace, err := util.GetNamespace(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			if len(cfg.RBACServiceAccount) > 0 {
+				if err := dumpObuRBAC(cfg, verbs, namespace, os.Stdout); err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				}
+				return
+			}
+			// access reviews need the authorizer of a live cluster, exported manifests cannot answer them
+			if util.IsOffline(cfg) {
+				fmt.Fprintf(os.Stderr, "ERROR: access can only be checked against a live cluster\n")
+				return
+			}
+			clients, err := util.GetClients(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem with kubeconfig: %v\n", err)
+				return
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			for _, verb := range verbs {
+				fmt.Fprintf(w, "%s:\n", verb)
+				fmt.Fprintf(w, "  VERB\tRESOURCE\tNAMESPACE\tNAME\tALLOWED\tWHEN\n")
+				for _, rule := range obuVerbAccess[verb] {
+					allowed, err := canI(clients, rule, namespace)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "ERROR: problem reviewing access to %s: %v\n", rule.groupResource(), err)
+						return
+					}
+					fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%s\n", rule.verb, rule.groupResource(),
+						rule.getNamespace(namespace), rule.name, yesNo(allowed), rule.when)
+				}
+			}
+			w.Flush()
+		},
+	}
+	canICmd.Flags().StringVar(&(cfg.RBACServiceAccount), "service-account", cfg.RBACServiceAccount,
+		"Rather than checking access, emit the Roles, ClusterRole and bindings that grant it to this service account in the namespace.")
+	canICmd.Flags().StringVar(&(cfg.RBACRoleName), "role-name", "obu",
+		"The name of the emitted Roles, ClusterRole and bindings, followed by the verbs they grant unless all of them are.")
+	return canICmd
+}
+
+func getObuVerbs(args []string) ([]string, error) {
+	known := []string{}
+	for verb := range obuVerbAccess {
+		known = append(known, verb)
+	}
+	sort.Strings(known)
+	if len(args) == 0 {
+		return known, nil
+	}
+	for _, arg := range args {
+		if _, ok := obuVerbAccess[arg]; !ok {
+			return nil, fmt.Errorf("unknown obu verb %q (use one of %s)", arg, strings.Join(known, ", "))
+		}
+	}
+	return args, nil
+}
+
+func (r accessRule) groupResource() string {
+	if len(r.group) == 0 {
+		return r.resource
+	}
+	parts := strings.SplitN(r.resource, "/", 2)
+	parts[0] = parts[0] + "." + r.group
+	return strings.Join(parts, "/")
+}
+
+func (r accessRule) getNamespace(namespace string) string {
+	switch {
+	case r.clusterScoped:
+		return ""
+	case len(r.namespace) > 0:
+		return r.namespace
+	}
+	return namespace
+}
+
+func canI(clients *util.Clients, rule accessRule, namespace string) (bool, error) {
+	resource := strings.SplitN(rule.resource, "/", 2)
+	attributes := &authorizationv1.ResourceAttributes{
+		Namespace: rule.getNamespace(namespace),
+		Verb:      rule.verb,
+		Group:     rule.group,
+		Resource:  resource[0],
+		Name:      rule.name,
+	}
+	if len(resource) == 2 {
+		attributes.Subresource = resource[1]
+	}
+	review, err := clients.Core.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: attributes},
+	})
+	if err != nil {
+		return false, err
+	}
+	return review.Status.Allowed, nil
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// dumpObuRBAC writes a Role and RoleBinding for each namespace the verbs make calls in, and a ClusterRole and
+// ClusterRoleBinding for the cluster scoped calls, all granting access to the service account.  They are named after
+// the verbs, so that granting different sets of verbs adds to rather than replaces the access granted before.
+func dumpObuRBAC(cfg *api.Config, verbs []string, namespace string, out io.Writer) error {
+	roleName := getObuRoleName(cfg.RBACRoleName, verbs)
+	namespacedRules := map[string][]rbacv1.PolicyRule{}
+	clusterRules := []rbacv1.PolicyRule{}
+	for _, verb := range verbs {
+		for _, rule := range obuVerbAccess[verb] {
+			policyRule := rbacv1.PolicyRule{
+				Verbs:     []string{rule.verb},
+				APIGroups: []string{rule.group},
+				Resources: []string{rule.resource},
+			}
+			if len(rule.name) > 0 {
+				policyRule.ResourceNames = []string{rule.name}
+			}
+			if rule.clusterScoped {
+				clusterRules = addPolicyRule(clusterRules, policyRule)
+				continue
+			}
+			ns := rule.getNamespace(namespace)
+			namespacedRules[ns] = addPolicyRule(namespacedRules[ns], policyRule)
+		}
+	}
+
+	subjects := []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: cfg.RBACServiceAccount, Namespace: namespace}}
+	objs := []interface{}{}
+	namespaces := []string{}
+	for ns := range namespacedRules {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		objs = append(objs,
+			&rbacv1.Role{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "Role"},
+				ObjectMeta: metav1.ObjectMeta{Name: roleName, Namespace: ns},
+				Rules:      namespacedRules[ns],
+			},
+			&rbacv1.RoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+				ObjectMeta: metav1.ObjectMeta{Name: roleName, Namespace: ns},
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: roleName},
+				Subjects:   subjects,
+			})
+	}
+	if len(clusterRules) > 0 {
+		// the cluster role is bound per service account, so the binding name includes it
+		bindingName := fmt.Sprintf("%s-%s-%s", roleName, namespace, cfg.RBACServiceAccount)
+		objs = append(objs,
+			&rbacv1.ClusterRole{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRole"},
+				ObjectMeta: metav1.ObjectMeta{Name: roleName},
+				Rules:      clusterRules,
+			},
+			&rbacv1.ClusterRoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRoleBinding"},
+				ObjectMeta: metav1.ObjectMeta{Name: bindingName},
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: roleName},
+				Subjects:   subjects,
+			})
+	}
+
+	for i, obj := range objs {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintf(out, "---\n")
+		}
+		fmt.Fprintf(out, "%s", data)
+	}
+	return nil
+}
+
+// getObuRoleName appends the sorted verbs to the role name, unless all of the verbs are granted
+func getObuRoleName(prefix string, verbs []string) string {
+	selected := map[string]bool{}
+	for _, verb := range verbs {
+		selected[verb] = true
+	}
+	if len(selected) == len(obuVerbAccess) {
+		return prefix
+	}
+	names := []string{}
+	for verb := range selected {
+		names = append(names, verb)
+	}
+	sort.Strings(names)
+	return prefix + "-" + strings.Join(names, "-")
+}
+
+// addPolicyRule merges the verb of a single verb rule into an existing rule for the same resource and names
+func addPolicyRule(rules []rbacv1.PolicyRule, rule rbacv1.PolicyRule) []rbacv1.PolicyRule {
+	for i, existing := range rules {
+		if existing.APIGroups[0] != rule.APIGroups[0] || existing.Resources[0] != rule.Resources[0] ||
+			strings.Join(existing.ResourceNames, ",") != strings.Join(rule.ResourceNames, ",") {
+			continue
+		}
+		for _, verb := range existing.Verbs {
+			if verb == rule.Verbs[0] {
+				return rules
+			}
+		}
+		rules[i].Verbs = append(rules[i].Verbs, rule.Verbs[0])
+		return rules
+	}
+	return append(rules, rule)
+}
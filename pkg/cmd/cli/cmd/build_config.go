@@ -0,0 +1,273 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// the ConfigMap and Secret are named after the service account, as its credentials end up in them
+	buildConfigMapNamePrefix     = "obu-build-config-"
+	buildAuthSecretNamePrefix    = "obu-build-auth-"
+	buildConfigCABundleKey       = "ca-bundle.crt"
+	buildConfigRegistriesConfKey = "registries.conf"
+
+	// buildConfigManagedByLabel marks the ConfigMap and Secret as owned by obu
+	buildConfigManagedByLabel = "app.kubernetes.io/managed-by"
+	buildConfigManagedByValue = "obu"
+	// buildConfigHashAnnotation is the hash of the data obu last wrote
+	buildConfigHashAnnotation = "obu.gabemontero.github.io/build-config-hash"
+)
+
+// buildConfigData is everything the proxy, registry and mirror verbs provide a build tool with, gathered in one go
+// so that it can be stored in a ConfigMap and Secret that build pods mount.
+type buildConfigData struct {
+	// the proxy environment variables, in both the upper and lower case forms tools look for, when set
+	ProxyEnv map[string]string
+	// the proxy, internal registry and mirror registry CAs
+	CABundle       string
+	RegistriesConf string
+	// nil when the service account has no credentials for the internal registry
+	DockerConfigJSON []byte
+}
+
+// getBuildConfigData gathers the build configuration for the service account in cfg.  Missing CAs and credentials
+// are only warned about, as builds can very well work without them.
+func getBuildConfigData(cfg *api.Config, clients *util.Clients, namespace string) (*buildConfigData, error) {
+	data := &buildConfigData{ProxyEnv: map[string]string{}}
+
+	// builds get the default proxy of the cluster's build config, which takes precedence over the global proxy
+	proxy, err := getEffectiveProxy(clients, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range map[string]string{
+		"HTTP_PROXY":  proxy.HTTPProxy.Value,
+		"HTTPS_PROXY": proxy.HTTPSProxy.Value,
+		"NO_PROXY":    proxy.NoProxy.Value,
+	} {
+		if len(value) > 0 {
+			data.ProxyEnv[name] = value
+			data.ProxyEnv[strings.ToLower(name)] = value
+		}
+	}
+
+	imageConfig, err := clients.Config.ConfigV1().Images().Get("cluster", metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("problem getting global image config: %v", err)
+	}
+	data.RegistriesConf, err = getBuildRegistriesConfigData(clients, imageConfig)
+	if err != nil {
+		return nil, fmt.Errorf("problem building registry config: %v", err)
+	}
+
+	if proxyCAData, err := getGlobalProxyCAData(clients); err == nil {
+		data.CABundle += proxyCAData
+	} else if len(proxy.HTTPSProxy.Value) > 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+	}
+	if registryCAData, err := getImageRegistryCAData(clients); err == nil {
+		data.CABundle += registryCAData
+	} else {
+		fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+	}
+	if mirrorCAData, err := getMirrorRegistryCAData(clients, imageConfig); err == nil {
+		data.CABundle += mirrorCAData
+	} else {
+		fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+	}
+
+	if dockerConfig, err := getMergedDockerConfig(cfg, clients, namespace); err == nil {
+		data.DockerConfigJSON, err = json.Marshal(dockerConfig)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "WARNING: not providing registry credentials: %v\n", err)
+	}
+	return data, nil
+}
+
+// getMergedDockerConfig combines the internal registry credentials with those of every other docker secret of the
+// service account, i.e. image pull secrets for external and mirror registries, into a single normalized config.
+func getMergedDockerConfig(cfg *api.Config, clients *util.Clients, namespace string) (*DockerConfigJson, error) {
+	registrySecret, _, err := getRegistryAuthSecret(cfg, clients, namespace)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := normalizeDockerConfig(registrySecret)
+	if err != nil {
+		return nil, err
+	}
+	sa, err := clients.Core.CoreV1().ServiceAccounts(namespace).Get(cfg.ServiceAccount, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	secretNames := []string{}
+	for _, ref := range sa.Secrets {
+		secretNames = append(secretNames, ref.Name)
+	}
+	for _, ref := range sa.ImagePullSecrets {
+		secretNames = append(secretNames, ref.Name)
+	}
+	for _, secretName := range secretNames {
+		if secretName == registrySecret.Name {
+			continue
+		}
+		secret, err := clients.Core.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+		// a service account commonly lists image pull secrets that were never created, or have since been deleted
+		if kerrors.IsNotFound(err) {
+			fmt.Fprintf(os.Stderr, "WARNING: skipping secret %s of service account %s: %v\n", secretName, cfg.ServiceAccount, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if secret.Type != corev1.SecretTypeDockercfg && secret.Type != corev1.SecretTypeDockerConfigJson {
+			continue
+		}
+		normalized, err := normalizeDockerConfig(secret)
+		if err != nil {
+			return nil, err
+		}
+		// the internal registry credentials obu picked take precedence
+		for hostPort, entry := range normalized.Auths {
+			if _, exists := merged.Auths[hostPort]; !exists {
+				merged.Auths[hostPort] = entry
+			}
+		}
+	}
+	return merged, nil
+}
+
+func getBuildConfigMapName(serviceAccount string) string {
+	return buildConfigMapNamePrefix + serviceAccount
+}
+
+func getBuildAuthSecretName(serviceAccount string) string {
+	return buildAuthSecretNamePrefix + serviceAccount
+}
+
+func newBuildConfigMap(namespace, serviceAccount string, data *buildConfigData) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: newBuildConfigObjectMeta(namespace, getBuildConfigMapName(serviceAccount)),
+		Data: map[string]string{
+			buildConfigCABundleKey:       data.CABundle,
+			buildConfigRegistriesConfKey: data.RegistriesConf,
+		},
+	}
+	// the proxy settings are stored under their environment variable names so that they can be used with envFrom
+	for name, value := range data.ProxyEnv {
+		cm.Data[name] = value
+	}
+	cm.Annotations[buildConfigHashAnnotation] = hashBuildConfig(cm.Data)
+	return cm
+}
+
+// newBuildAuthSecret returns nil when there are no credentials to store
+func newBuildAuthSecret(namespace, serviceAccount string, data *buildConfigData) *corev1.Secret {
+	if data.DockerConfigJSON == nil {
+		return nil
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: newBuildConfigObjectMeta(namespace, getBuildAuthSecretName(serviceAccount)),
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: data.DockerConfigJSON},
+	}
+	secret.Annotations[buildConfigHashAnnotation] = hashBuildConfig(secret.Data)
+	return secret
+}
+
+func newBuildConfigObjectMeta(namespace, name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:        name,
+		Namespace:   namespace,
+		Labels:      map[string]string{buildConfigManagedByLabel: buildConfigManagedByValue},
+		Annotations: map[string]string{},
+	}
+}
+
+// hashBuildConfig hashes ConfigMap or Secret data; maps are marshalled with sorted keys, so equal data hashes the same
+func hashBuildConfig(data interface{}) string {
+	content, _ := json.Marshal(data)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// applyBuildConfig creates the build ConfigMap and Secret, or updates them when the hash of their live contents
+// differs, so that edits made to them are reverted too, returning what was done to each in the form
+// 'configmap/<name> created'.  Objects of these names without the managed-by label, like those the webhook created
+// before it set it, are adopted.
+func applyBuildConfig(clients *util.Clients, cm *corev1.ConfigMap, secret *corev1.Secret) ([]string, error) {
+	results := []string{}
+	cmClient := clients.Core.CoreV1().ConfigMaps(cm.Namespace)
+	existingCM, err := cmClient.Get(cm.Name, metav1.GetOptions{})
+	switch {
+	case kerrors.IsNotFound(err):
+		if _, err := cmClient.Create(cm); err != nil {
+			return results, fmt.Errorf("problem creating config map %s/%s: %v", cm.Namespace, cm.Name, err)
+		}
+		results = append(results, "configmap/"+cm.Name+" created")
+	case err != nil:
+		return results, fmt.Errorf("problem retrieving config map %s/%s: %v", cm.Namespace, cm.Name, err)
+	case existingCM.Labels[buildConfigManagedByLabel] == buildConfigManagedByValue &&
+		hashBuildConfig(existingCM.Data) == cm.Annotations[buildConfigHashAnnotation]:
+		results = append(results, "configmap/"+cm.Name+" unchanged")
+	default:
+		existingCM.Data = cm.Data
+		existingCM.ObjectMeta = mergeBuildConfigObjectMeta(existingCM.ObjectMeta, cm.ObjectMeta)
+		if _, err := cmClient.Update(existingCM); err != nil {
+			return results, fmt.Errorf("problem updating config map %s/%s: %v", cm.Namespace, cm.Name, err)
+		}
+		results = append(results, "configmap/"+cm.Name+" configured")
+	}
+	if secret == nil {
+		return results, nil
+	}
+
+	secretClient := clients.Core.CoreV1().Secrets(secret.Namespace)
+	existingSecret, err := secretClient.Get(secret.Name, metav1.GetOptions{})
+	switch {
+	case kerrors.IsNotFound(err):
+		if _, err := secretClient.Create(secret); err != nil {
+			return results, fmt.Errorf("problem creating secret %s/%s: %v", secret.Namespace, secret.Name, err)
+		}
+		results = append(results, "secret/"+secret.Name+" created")
+	case err != nil:
+		return results, fmt.Errorf("problem retrieving secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	case existingSecret.Labels[buildConfigManagedByLabel] == buildConfigManagedByValue &&
+		hashBuildConfig(existingSecret.Data) == secret.Annotations[buildConfigHashAnnotation]:
+		results = append(results, "secret/"+secret.Name+" unchanged")
+	default:
+		existingSecret.Data = secret.Data
+		existingSecret.ObjectMeta = mergeBuildConfigObjectMeta(existingSecret.ObjectMeta, secret.ObjectMeta)
+		if _, err := secretClient.Update(existingSecret); err != nil {
+			return results, fmt.Errorf("problem updating secret %s/%s: %v", secret.Namespace, secret.Name, err)
+		}
+		results = append(results, "secret/"+secret.Name+" configured")
+	}
+	return results, nil
+}
+
+// mergeBuildConfigObjectMeta sets the managed-by label and hash annotation of the desired object on the live one
+func mergeBuildConfigObjectMeta(existing, desired metav1.ObjectMeta) metav1.ObjectMeta {
+	if existing.Labels == nil {
+		existing.Labels = map[string]string{}
+	}
+	existing.Labels[buildConfigManagedByLabel] = buildConfigManagedByValue
+	if existing.Annotations == nil {
+		existing.Annotations = map[string]string{}
+	}
+	existing.Annotations[buildConfigHashAnnotation] = desired.Annotations[buildConfigHashAnnotation]
+	return existing
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gabemontero/obu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestApplyBuildConfig(t *testing.T) {
+	data := &buildConfigData{
+		ProxyEnv:         map[string]string{"HTTP_PROXY": "http://proxy:3128", "http_proxy": "http://proxy:3128"},
+		CABundle:         "ca",
+		DockerConfigJSON: []byte(`{"auths":{}}`),
+	}
+	cm := newBuildConfigMap("demo", "pipeline", data)
+	secret := newBuildAuthSecret("demo", "pipeline", data)
+	edited := cm.DeepCopy()
+	edited.Data["HTTP_PROXY"] = "http://other:8080"
+
+	tests := []struct {
+		name     string
+		existing []*corev1.ConfigMap
+		expected []string
+	}{
+		{
+			name:     "created",
+			expected: []string{"configmap/obu-build-config-pipeline created", "secret/obu-build-auth-pipeline created"},
+		},
+		{
+			name:     "unchanged",
+			existing: []*corev1.ConfigMap{cm.DeepCopy()},
+			expected: []string{"configmap/obu-build-config-pipeline unchanged", "secret/obu-build-auth-pipeline created"},
+		},
+		{
+			name:     "edited in place",
+			existing: []*corev1.ConfigMap{edited},
+			expected: []string{"configmap/obu-build-config-pipeline configured", "secret/obu-build-auth-pipeline created"},
+		},
+		{
+			name: "created without the managed-by label",
+			existing: []*corev1.ConfigMap{{
+				ObjectMeta: metav1.ObjectMeta{Name: getBuildConfigMapName("pipeline"), Namespace: "demo"},
+				Data:       cm.Data,
+			}},
+			expected: []string{"configmap/obu-build-config-pipeline configured", "secret/obu-build-auth-pipeline created"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			coreClient := kubefake.NewSimpleClientset()
+			for _, existing := range test.existing {
+				if _, err := coreClient.CoreV1().ConfigMaps("demo").Create(existing); err != nil {
+					t.Fatalf("unexpected error creating config map: %v", err)
+				}
+			}
+			results, err := applyBuildConfig(&util.Clients{Core: coreClient}, cm.DeepCopy(), secret.DeepCopy())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(results, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, results)
+			}
+			applied, err := coreClient.CoreV1().ConfigMaps("demo").Get(getBuildConfigMapName("pipeline"), metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error retrieving config map: %v", err)
+			}
+			if !reflect.DeepEqual(applied.Data, cm.Data) || applied.Labels[buildConfigManagedByLabel] != buildConfigManagedByValue {
+				t.Errorf("expected the build config map to be managed by obu with data %v, got %#v", cm.Data, applied)
+			}
+		})
+	}
+}
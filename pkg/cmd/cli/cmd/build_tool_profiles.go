@@ -0,0 +1,279 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// buildToolProfile captures where a given image build tool expects to find registry credentials and configuration.
+// Any empty location means the tool has no file based equivalent for that piece of configuration.
+type buildToolProfile struct {
+	// authFile is the docker config.json style credentials file the tool reads
+	authFile func() string
+	// certsDir holds per registry CAs in the <certsDir>/<host:port>/ca.crt layout
+	certsDir string
+	// caBundleFile is a PEM bundle the tool adds to its trusted CAs
+	caBundleFile string
+	// registriesConf is the containers registries.conf file the tool reads for mirrors and blocked/insecure registries
+	registriesConf string
+}
+
+var buildToolProfiles = map[string]buildToolProfile{
+	"buildah": {
+		authFile:       containersAuthFile,
+		certsDir:       "/etc/containers/certs.d",
+		registriesConf: "/etc/containers/registries.conf",
+	},
+	"skopeo": {
+		authFile:       containersAuthFile,
+		certsDir:       "/etc/containers/certs.d",
+		registriesConf: "/etc/containers/registries.conf",
+	},
+	"kaniko": {
+		authFile: func() string { return "/kaniko/.docker/config.json" },
+		// kaniko sets SSL_CERT_DIR to this directory, so any PEM file placed there is trusted
+		caBundleFile: "/kaniko/ssl/certs/openshift-image-registry-ca.crt",
+	},
+	"jib": {
+		authFile: dockerAuthFile,
+	},
+	"s2i": {
+		authFile: dockerAuthFile,
+		certsDir: "/etc/docker/certs.d",
+	},
+}
+
+func buildToolNames() []string {
+	names := []string{}
+	for name := range buildToolProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getBuildToolProfile(name string) (buildToolProfile, error) {
+	profile, exists := buildToolProfiles[name]
+	if !exists {
+		return profile, fmt.Errorf("unsupported build tool %q, use one of %s", name, strings.Join(buildToolNames(), ", "))
+	}
+	return profile, nil
+}
+
+func containersAuthFile() string {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); len(runtimeDir) > 0 {
+		return filepath.Join(runtimeDir, "containers", "auth.json")
+	}
+	return filepath.Join("/run", "containers", fmt.Sprintf("%d", os.Getuid()), "auth.json")
+}
+
+func dockerAuthFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "/"
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// normalizeDockerConfig converts the credentials of either legacy dockercfg or dockerconfigjson secrets into the
+// 'auths' form every build tool understands, filling in the 'auth' field from the username and password.
+func normalizeDockerConfig(secret *corev1.Secret) (*DockerConfigJson, error) {
+	auths, err := getDockerConfigAuths(secret)
+	if err != nil {
+		return nil, err
+	}
+	normalized := &DockerConfigJson{Auths: DockerConfig{}}
+	for hostPort, entry := range auths {
+		if len(entry.Auth) == 0 && (len(entry.Username) > 0 || len(entry.Password) > 0) {
+			entry.Auth = base64.StdEncoding.EncodeToString([]byte(entry.Username + ":" + entry.Password))
+		}
+		normalized.Auths[hostPort] = entry
+	}
+	return normalized, nil
+}
+
+func getNormalizedDockerConfigFileString(secret *corev1.Secret) (string, error) {
+	normalized, err := normalizeDockerConfig(secret)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(normalized, "", "\t")
+	if err != nil {
+		return "", fmt.Errorf("ERROR: Problem encoding docker config for secret %s: %v", secret.Name, err)
+	}
+	return string(data), nil
+}
+
+// getDockerConfigEntryCredentials returns the username and password of an entry, decoding them from its auth field
+// when they are not set on their own
+func getDockerConfigEntryCredentials(entry DockerConfigEntry) (string, string, error) {
+	if len(entry.Username) > 0 || len(entry.Password) > 0 {
+		return entry.Username, entry.Password, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) == 1 {
+		return parts[0], "", nil
+	}
+	return parts[0], parts[1], nil
+}
+
+// jibAuthProperties are the prefixes of the system properties jib reads the credentials for pushing the image it
+// builds, and for pulling its base image, from
+var jibAuthProperties = []string{"jib.to.auth", "jib.from.auth"}
+
+// getJibAuthPropertiesString returns the credentials for the internal registry as the jib.to.auth and jib.from.auth
+// system properties, in the Java properties file format, with the password masked when redacting.
+func getJibAuthPropertiesString(secret *corev1.Secret, registryHosts []string, redact bool) (string, error) {
+	normalized, err := normalizeDockerConfig(secret)
+	if err != nil {
+		return "", err
+	}
+	hostPorts := []string{}
+	for hostPort := range normalized.Auths {
+		if isImageRegistryHost(hostPort, registryHosts) {
+			hostPorts = append(hostPorts, hostPort)
+		}
+	}
+	if len(hostPorts) == 0 {
+		return "", fmt.Errorf("secret %s has no credentials for image registry hosts %s", secret.Name, strings.Join(registryHosts, ", "))
+	}
+	// every entry of a service account's dockercfg secret holds the same token, so any of them will do
+	sort.Strings(hostPorts)
+	username, password, err := getDockerConfigEntryCredentials(normalized.Auths[hostPorts[0]])
+	if err != nil {
+		return "", fmt.Errorf("problem decoding the credentials of secret %s for %s: %v", secret.Name, hostPorts[0], err)
+	}
+	if redact {
+		password = redactedValue
+	}
+	out := &strings.Builder{}
+	for _, prefix := range jibAuthProperties {
+		fmt.Fprintf(out, "%s.username=%s\n", prefix, username)
+		fmt.Fprintf(out, "%s.password=%s\n", prefix, password)
+	}
+	return out.String(), nil
+}
+
+// installBuildToolConfig writes the internal registry credentials and CA, along with any mirror registries config,
+// to the locations the requested build tool reads them from, and lists the files it wrote.  Existing auth files and
+// registries.conf files are merged into rather than replaced.
+func installBuildToolConfig(cfg *api.Config, clients *util.Clients, registryCAData string) error {
+	profile, err := getBuildToolProfile(cfg.BuildTool)
+	if err != nil {
+		return err
+	}
+	namespace, err := util.GetNamespace(cfg)
+	if err != nil {
+		return err
+	}
+	builderSecret, registryHosts, err := getRegistryAuthSecret(cfg, clients, namespace)
+	if err != nil {
+		return err
+	}
+	normalized, err := normalizeDockerConfig(builderSecret)
+	if err != nil {
+		return err
+	}
+	authFile := profile.authFile()
+	authData, err := json.MarshalIndent(normalized, "", "\t")
+	if err != nil {
+		return err
+	}
+	// the credentials the image already has, e.g. for docker hub or quay.io, are kept, with the cluster's merged in
+	if existing, err := ioutil.ReadFile(authFile); err == nil && len(bytes.TrimSpace(existing)) > 0 {
+		authData, err = mergeDockerConfigData(existing, normalized)
+		if err != nil {
+			return fmt.Errorf("problem merging credentials into %s: %v", authFile, err)
+		}
+	}
+	files := map[string][]byte{authFile: authData}
+
+	if len(profile.certsDir) > 0 {
+		for hostPort := range normalized.Auths {
+			if isImageRegistryHost(hostPort, registryHosts) {
+				files[filepath.Join(profile.certsDir, hostPort, "ca.crt")] = []byte(registryCAData)
+			}
+		}
+	}
+	if len(profile.caBundleFile) > 0 {
+		files[profile.caBundleFile] = []byte(registryCAData)
+	}
+	if len(profile.registriesConf) > 0 {
+		imageConfig, err := clients.Config.ConfigV1().Images().Get("cluster", metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("problem getting global image config: %v", err)
+		}
+		policies, err := getImageContentSourcePolicies(clients)
+		if err != nil {
+			return fmt.Errorf("problem building registry config: %v", err)
+		}
+		registriesConf, err := createBuildRegistriesConfigData(imageConfig, policies)
+		if err != nil {
+			return fmt.Errorf("problem building registry config: %v", err)
+		}
+		// the image's own registries.conf, i.e. its search registries, is kept, with the cluster's settings merged in
+		if existing, err := ioutil.ReadFile(profile.registriesConf); err == nil && len(registriesConf) > 0 {
+			registriesConf, err = mergeBuildRegistriesConfigData(string(existing), imageConfig, policies)
+			if err != nil {
+				return fmt.Errorf("problem merging registry config into %s: %v", profile.registriesConf, err)
+			}
+		}
+		if len(registriesConf) > 0 {
+			files[profile.registriesConf] = []byte(registriesConf)
+		}
+	}
+
+	paths := []string{}
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if path == authFile {
+			if err := writeCredentialsFile(path, string(files[path])); err != nil {
+				return err
+			}
+		} else if err := ioutil.WriteFile(path, files[path], 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", path)
+	}
+	return nil
+}
+
+// mergeDockerConfigData lays the auths of config over those of an existing docker config file, keeping its other
+// registries and any settings obu does not know about, like credential helpers.
+func mergeDockerConfigData(existing []byte, config *DockerConfigJson) ([]byte, error) {
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(existing, &raw); err != nil {
+		return nil, fmt.Errorf("problem parsing the existing docker config: %v", err)
+	}
+	auths, ok := raw["auths"].(map[string]interface{})
+	if !ok {
+		auths = map[string]interface{}{}
+	}
+	for hostPort, entry := range config.Auths {
+		auths[hostPort] = entry
+	}
+	raw["auths"] = auths
+	return json.MarshalIndent(raw, "", "\t")
+}
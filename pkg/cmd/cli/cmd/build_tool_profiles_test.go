@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMergeDockerConfigData(t *testing.T) {
+	existing := []byte(`{
+	"auths": {
+		"https://index.docker.io/v1/": {"auth": "aHViOmh1YnBhc3M="},
+		"image-registry.openshift-image-registry.svc:5000": {"auth": "b2xkOm9sZA=="}
+	},
+	"credHelpers": {"quay.io": "secretservice"}
+}`)
+	config := &DockerConfigJson{Auths: DockerConfig{
+		"image-registry.openshift-image-registry.svc:5000": DockerConfigEntry{Username: "serviceaccount", Password: "token"},
+	}}
+	merged, err := mergeDockerConfigData(existing, config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result := struct {
+		Auths       DockerConfig      `json:"auths"`
+		CredHelpers map[string]string `json:"credHelpers"`
+	}{}
+	if err := json.Unmarshal(merged, &result); err != nil {
+		t.Fatalf("unexpected error parsing %s: %v", merged, err)
+	}
+	expected := DockerConfig{
+		"https://index.docker.io/v1/":                      DockerConfigEntry{Auth: "aHViOmh1YnBhc3M="},
+		"image-registry.openshift-image-registry.svc:5000": DockerConfigEntry{Username: "serviceaccount", Password: "token"},
+	}
+	if !reflect.DeepEqual(result.Auths, expected) {
+		t.Errorf("expected auths %#v, got %#v", expected, result.Auths)
+	}
+	if result.CredHelpers["quay.io"] != "secretservice" {
+		t.Errorf("expected the credential helpers to be kept, got %s", merged)
+	}
+
+	if _, err := mergeDockerConfigData([]byte("not json"), config); err == nil {
+		t.Errorf("expected an error for an unparseable docker config")
+	}
+}
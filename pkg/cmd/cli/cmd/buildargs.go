@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+	buildv1 "github.com/openshift/api/build/v1"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// shellSafeRegex matches the arguments that do not need quoting for a POSIX shell
+var shellSafeRegex = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+func NewCmdBuildArgs(cfg *api.Config) *cobra.Command {
+	buildArgsCmd := &cobra.Command{
+		Use:   "buildargs <buildconfig> [<options>]",
+		Short: "Translate a BuildConfig's Docker strategy into buildah arguments.",
+		Long: "Translate the build args, environment, no cache, force pull, pull secret, Dockerfile path, image\n" +
+			"optimization policy and from image of a BuildConfig's Docker strategy, along with its source context\n" +
+			"directory, into the arguments of 'buildah bud'.  Build args and environment variables taken from\n" +
+			"ConfigMaps and Secrets are resolved.  Values from Secrets are printed as is, so that the arguments can be\n" +
+			"passed on to buildah, with a warning when stdout is a terminal; --redact masks them.",
+		Example: `
+# Build the way the 'myapp' BuildConfig would, from the root of its source repository
+$ eval buildah bud $(obu buildargs myapp) -t myapp:latest
+
+# Emit the arguments as a JSON array, for a Tekton array param
+$ obu buildargs myapp --output json --output-file buildargs.json
+
+# Refer to the pull secret at the location it is mounted at in a Task step
+$ obu buildargs myapp --pull-secret-file /workspace/pull-secret/.dockerconfigjson
+`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if cfg.BuildArgsOutput != "args" && cfg.BuildArgsOutput != "json" {
+				fmt.Fprintf(os.Stderr, "ERROR: unsupported output %q, use args or json\n", cfg.BuildArgsOutput)
+				return
+			}
+			clients, err := util.GetClients(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem with kubeconfig: %v\n", err)
+				return
+			}
+			namespace, err := util.GetNamespace(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			bc, err := clients.Build.BuildV1().BuildConfigs(namespace).Get(args[0], metav1.GetOptions{})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem retrieving build config %s: %v\n", args[0], err)
+				return
+			}
+			buildahArgs, err := getBuildahArgs(cfg, clients, bc)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+
+			output := ""
+			switch cfg.BuildArgsOutput {
+			case "json":
+				data, err := json.Marshal(buildahArgs)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: problem encoding arguments: %v\n", err)
+					return
+				}
+				output = string(data)
+			default:
+				quoted := []string{}
+				for _, arg := range buildahArgs {
+					quoted = append(quoted, shellQuote(arg))
+				}
+				output = strings.Join(quoted, " ")
+			}
+			if len(cfg.OutputFile) > 0 {
+				// the arguments can hold secret values, so they are handled like credentials
+				if err := writeCredentialsFile(util.GetTektonOutputFile(cfg.OutputFile, util.TektonWorkspaceDir), output); err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				}
+				return
+			}
+			fmt.Fprintf(os.Stdout, "%s\n", output)
+		},
+	}
+	buildArgsCmd.Flags().StringVar(&(cfg.BuildArgsOutput), "output", "args",
+		"The output format, either 'args' for shell quoted arguments or 'json' for a JSON array of arguments.")
+	buildArgsCmd.Flags().StringVar(&(cfg.PullSecretFile), "pull-secret-file", "/var/run/secrets/openshift.io/pull/.dockerconfigjson",
+		"Where the contents of the strategy's pull secret are available to buildah, i.e. as written by 'obu registry --secret <pull secret> --docker-cfg-file --for buildah --output-file <file>'.  Defaults to where OpenShift builds mount it.")
+	buildArgsCmd.Flags().StringVar(&(cfg.OutputFile), "output-file", cfg.OutputFile,
+		"Write the arguments to this file, readable by its owner only, instead of stdout.  In a Tekton step, relative paths are under /workspace.")
+	buildArgsCmd.Flags().BoolVar(&(cfg.Redact), "redact", false,
+		"Mask the values taken from Secrets, which makes the arguments unusable for buildah.")
+	return buildArgsCmd
+}
+
+// getBuildahArgs maps the Docker strategy of the build config onto 'buildah bud' options, followed by the context
+// directory.  The flags OpenShift's own image builder would apply beyond these, like the output tag, are left to
+// the caller.
+func getBuildahArgs(cfg *api.Config, clients *util.Clients, bc *buildv1.BuildConfig) ([]string, error) {
+	strategy := bc.Spec.Strategy.DockerStrategy
+	if strategy == nil {
+		return nil, fmt.Errorf("build config %s does not use the Docker strategy", bc.Name)
+	}
+	buildahArgs := []string{}
+	if bc.Spec.Source.Dockerfile != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: build config %s has an inline Dockerfile, which has to be written to the Dockerfile path of the context directory\n", bc.Name)
+	}
+	contextDir := bc.Spec.Source.ContextDir
+	if len(contextDir) == 0 {
+		contextDir = "."
+	}
+	dockerfilePath := strategy.DockerfilePath
+	if len(dockerfilePath) == 0 {
+		dockerfilePath = "Dockerfile"
+	}
+	buildahArgs = append(buildahArgs, "--file", path.Join(contextDir, dockerfilePath))
+
+	for _, env := range strategy.BuildArgs {
+		value, err := resolveEnvVar(cfg, clients, bc.Namespace, env)
+		if err != nil {
+			return nil, fmt.Errorf("problem resolving build arg %s: %v", env.Name, err)
+		}
+		buildahArgs = append(buildahArgs, "--build-arg", env.Name+"="+value)
+	}
+	for _, env := range strategy.Env {
+		value, err := resolveEnvVar(cfg, clients, bc.Namespace, env)
+		if err != nil {
+			return nil, fmt.Errorf("problem resolving environment variable %s: %v", env.Name, err)
+		}
+		buildahArgs = append(buildahArgs, "--env", env.Name+"="+value)
+	}
+	if strategy.NoCache {
+		buildahArgs = append(buildahArgs, "--no-cache")
+	}
+	if strategy.ForcePull {
+		buildahArgs = append(buildahArgs, "--pull-always")
+	}
+	if strategy.PullSecret != nil {
+		buildahArgs = append(buildahArgs, "--authfile", cfg.PullSecretFile)
+	}
+	if policy := strategy.ImageOptimizationPolicy; policy != nil {
+		switch *policy {
+		case buildv1.ImageOptimizationSkipLayers, buildv1.ImageOptimizationSkipLayersAndWarn:
+			buildahArgs = append(buildahArgs, "--squash")
+		}
+	}
+	if strategy.From != nil {
+		ref := *strategy.From
+		if len(ref.Namespace) == 0 && ref.Kind != "DockerImage" {
+			ref.Namespace = bc.Namespace
+		}
+		ref, err := parseImageReference(ref)
+		if err != nil {
+			return nil, err
+		}
+		translateCfg := *cfg
+		translateCfg.SHA = true
+		from, err := translateObjectReference(&translateCfg, clients, ref)
+		if err != nil {
+			return nil, fmt.Errorf("problem resolving the strategy's from image %s: %v", ref.Name, err)
+		}
+		buildahArgs = append(buildahArgs, "--from", from)
+	}
+	return append(buildahArgs, contextDir), nil
+}
+
+// resolveEnvVar returns the value of an environment variable, reading it from the ConfigMap or Secret it refers to,
+// the only kinds of reference BuildConfigs allow.
+func resolveEnvVar(cfg *api.Config, clients *util.Clients, namespace string, env corev1.EnvVar) (string, error) {
+	if env.ValueFrom == nil {
+		return env.Value, nil
+	}
+	switch {
+	case env.ValueFrom.ConfigMapKeyRef != nil:
+		ref := env.ValueFrom.ConfigMapKeyRef
+		cm, err := clients.Core.CoreV1().ConfigMaps(namespace).Get(ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		if value, ok := cm.Data[ref.Key]; ok {
+			return value, nil
+		}
+		if value, ok := cm.BinaryData[ref.Key]; ok {
+			return string(value), nil
+		}
+		return "", fmt.Errorf("config map %s has no key %s", ref.Name, ref.Key)
+	case env.ValueFrom.SecretKeyRef != nil:
+		ref := env.ValueFrom.SecretKeyRef
+		secret, err := clients.Core.CoreV1().Secrets(namespace).Get(ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		value, ok := secret.Data[ref.Key]
+		if !ok {
+			return "", fmt.Errorf("secret %s has no key %s", ref.Name, ref.Key)
+		}
+		if cfg.Redact {
+			return redactedValue, nil
+		}
+		if len(cfg.OutputFile) == 0 && util.IsTerminal(os.Stdout) {
+			fmt.Fprintf(os.Stderr, "WARNING: the value of %s from secret %s is printed, mask it with --redact\n", env.Name, ref.Name)
+		}
+		return string(value), nil
+	}
+	return "", fmt.Errorf("only config map and secret references are supported")
+}
+
+// shellQuote quotes an argument for a POSIX shell, when it needs to be
+func shellQuote(arg string) string {
+	if shellSafeRegex.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,383 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+	imagev1 "github.com/openshift/api/image/v1"
+	imageset "github.com/openshift/client-go/image/clientset/versioned"
+	imageinformers "github.com/openshift/client-go/image/informers/externalversions"
+	imagelisters "github.com/openshift/client-go/image/listers/image/v1"
+	"github.com/openshift/library-go/pkg/image/imageutil"
+	"github.com/spf13/cobra"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	kubeset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// triggerTemplateAnnotation names the ConfigMap, in the image stream's namespace, holding the PipelineRun to
+	// create when one of the image stream's watched tags changes
+	triggerTemplateAnnotation = "obu.gabemontero.github.io/pipelinerun-template"
+	// triggerTagsAnnotation is the comma separated list of tags to watch, defaulting to 'latest'
+	triggerTagsAnnotation = "obu.gabemontero.github.io/trigger-tags"
+	// triggerParamAnnotation is the PipelineRun parameter the new image reference is passed in, defaulting to 'image'
+	triggerParamAnnotation = "obu.gabemontero.github.io/image-param"
+	// lastTriggeredAnnotation records, per tag, the image that last created a PipelineRun, so that restarts and
+	// leader changes do not trigger again for the same image
+	lastTriggeredAnnotation = "obu.gabemontero.github.io/last-triggered-images"
+
+	triggerImageStreamLabel = "obu.gabemontero.github.io/trigger-imagestream"
+	triggerTagLabel         = "obu.gabemontero.github.io/trigger-tag"
+
+	pipelineRunTemplateKey = "pipelinerun.yaml"
+	controllerName         = "obu-controller"
+	controllerWorkers      = 2
+)
+
+func NewCmdController(cfg *api.Config) *cobra.Command {
+	controllerCmd := &cobra.Command{
+		Use:   "controller [<options>]",
+		Short: "Start Tekton PipelineRuns when image stream tags change.",
+		Long: "Run a controller that provides the equivalent of BuildConfig ImageChange triggers for Tekton, creating a\n" +
+			"PipelineRun from a template whenever the image a watched image stream tag points to changes.",
+		Example: `
+# Annotate an image stream so that PipelineRuns are created from the 'pipelinerun.yaml' key of the
+# 'rebuild-myapp' ConfigMap whenever its 'latest' or '1.0' tags change, with the new image passed in
+# the 'base-image' parameter
+$ oc annotate is/mybase obu.gabemontero.github.io/pipelinerun-template=rebuild-myapp \
+    obu.gabemontero.github.io/trigger-tags=latest,1.0 obu.gabemontero.github.io/image-param=base-image
+
+# Watch the annotated image streams in the current namespace
+$ obu controller
+
+# Watch the annotated image streams in every namespace, waiting for tag updates to settle for 30 seconds
+$ obu controller --all-namespaces --debounce 30s
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			clients, err := util.GetClients(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem with kubeconfig: %v\n", err)
+				return
+			}
+			namespace, err := util.GetNamespace(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			watchNamespace := namespace
+			if cfg.AllNamespaces {
+				watchNamespace = metav1.NamespaceAll
+			}
+
+			ctx := util.SignalContext()
+
+			factory := imageinformers.NewSharedInformerFactoryWithOptions(clients.Image, 10*time.Minute,
+				imageinformers.WithNamespace(watchNamespace))
+			controller := newImageChangeController(cfg, clients.Core, clients.Image, clients.Dynamic, factory)
+			run := func(ctx context.Context) {
+				factory.Start(ctx.Done())
+				controller.run(ctx.Done())
+			}
+			if !cfg.LeaderElect {
+				run(ctx)
+				return
+			}
+
+			hostname, _ := os.Hostname()
+			lock, err := resourcelock.New(resourcelock.ConfigMapsResourceLock, namespace, controllerName,
+				clients.Core.CoreV1(), clients.Core.CoordinationV1(),
+				resourcelock.ResourceLockConfig{Identity: hostname + "_" + string(uuid.NewUUID())})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem creating leader election lock: %v\n", err)
+				return
+			}
+			leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+				Lock:          lock,
+				LeaseDuration: 15 * time.Second,
+				RenewDeadline: 10 * time.Second,
+				RetryPeriod:   2 * time.Second,
+				Callbacks: leaderelection.LeaderCallbacks{
+					OnStartedLeading: run,
+					OnStoppedLeading: func() {
+						fmt.Fprintf(os.Stderr, "obu controller lost leadership\n")
+					},
+				},
+				ReleaseOnCancel: true,
+			})
+		},
+	}
+	controllerCmd.Flags().BoolVar(&(cfg.AllNamespaces), "all-namespaces", cfg.AllNamespaces,
+		"Watch image streams in all namespaces.")
+	controllerCmd.Flags().BoolVar(&(cfg.LeaderElect), "leader-elect", true,
+		"Only act when elected leader, so that several replicas of the controller can run.")
+	controllerCmd.Flags().DurationVar(&(cfg.Debounce), "debounce", 10*time.Second,
+		"How long to wait after an image stream changes before acting on it, so that bursts of tag updates only create one PipelineRun per tag.")
+	return controllerCmd
+}
+
+type imageChangeController struct {
+	cfg           *api.Config
+	coreClient    kubeset.Interface
+	imageClient   imageset.Interface
+	dynamicClient dynamic.Interface
+
+	lister imagelisters.ImageStreamLister
+	synced cache.InformerSynced
+	queue  workqueue.RateLimitingInterface
+}
+
+// newImageChangeController wires the controller to its clients, which can just as well be fakes, and registers
+// its event handlers with the image stream informer from the factory.
+func newImageChangeController(cfg *api.Config, coreClient kubeset.Interface, imageClient imageset.Interface, dynamicClient dynamic.Interface, factory imageinformers.SharedInformerFactory) *imageChangeController {
+	informer := factory.Image().V1().ImageStreams()
+	c := &imageChangeController{
+		cfg:           cfg,
+		coreClient:    coreClient,
+		imageClient:   imageClient,
+		dynamicClient: dynamicClient,
+		lister:        informer.Lister(),
+		synced:        informer.Informer().HasSynced,
+		queue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), controllerName),
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(old, new interface{}) { c.enqueue(new) },
+	})
+	return c
+}
+
+func (c *imageChangeController) enqueue(obj interface{}) {
+	is, ok := obj.(*imagev1.ImageStream)
+	if !ok {
+		return
+	}
+	if _, triggered := is.Annotations[triggerTemplateAnnotation]; !triggered {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(is)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	// an image stream already waiting in the queue is not added again, which coalesces bursts of updates
+	c.queue.AddAfter(key, c.cfg.Debounce)
+}
+
+func (c *imageChangeController) run(stop <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	if !cache.WaitForCacheSync(stop, c.synced) {
+		utilruntime.HandleError(fmt.Errorf("timed out waiting for the image stream cache to sync"))
+		return
+	}
+	for i := 0; i < controllerWorkers; i++ {
+		go wait.Until(func() {
+			for c.processNextItem() {
+			}
+		}, time.Second, stop)
+	}
+	<-stop
+}
+
+func (c *imageChangeController) processNextItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	err := c.sync(key.(string))
+	if err == nil {
+		c.queue.Forget(key)
+		return true
+	}
+	utilruntime.HandleError(fmt.Errorf("problem handling image stream %s: %v", key, err))
+	c.queue.AddRateLimited(key)
+	return true
+}
+
+// sync creates a PipelineRun for each watched tag of the image stream whose latest image differs from the one
+// that last triggered, recording each image on the image stream as soon as its PipelineRun is created.
+func (c *imageChangeController) sync(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	is, err := c.lister.ImageStreams(namespace).Get(name)
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	templateName, triggered := is.Annotations[triggerTemplateAnnotation]
+	if !triggered {
+		return nil
+	}
+	tags := []string{imagev1.DefaultImageTag}
+	if tagList := is.Annotations[triggerTagsAnnotation]; len(tagList) > 0 {
+		tags = strings.Split(tagList, ",")
+	}
+	param := is.Annotations[triggerParamAnnotation]
+	if len(param) == 0 {
+		param = "image"
+	}
+	if len(getUntriggeredTags(is, tags)) == 0 {
+		return nil
+	}
+
+	// the cached image stream can lag behind the images recorded by an earlier sync that failed part way
+	is, err = c.imageClient.ImageV1().ImageStreams(namespace).Get(name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, tag := range getUntriggeredTags(is, tags) {
+		latest := imageutil.LatestTaggedImage(is, tag)
+		img, err := translateImageStreamTag(c.cfg, is, tag)
+		if err != nil {
+			return err
+		}
+		if err := c.createPipelineRun(is, tag, img, templateName, param); err != nil {
+			return err
+		}
+		// recorded right away, so that retrying a failure for a later tag does not trigger this one again
+		if err := c.recordTriggered(namespace, name, tag, latest.Image); err != nil {
+			return fmt.Errorf("problem recording the image that triggered tag %s: %v", tag, err)
+		}
+	}
+	return nil
+}
+
+// getLastTriggered returns the images that last triggered, by tag, as recorded on the image stream
+func getLastTriggered(is *imagev1.ImageStream) map[string]string {
+	lastTriggered := map[string]string{}
+	if data := is.Annotations[lastTriggeredAnnotation]; len(data) > 0 {
+		if err := json.Unmarshal([]byte(data), &lastTriggered); err != nil {
+			utilruntime.HandleError(fmt.Errorf("ignoring invalid %s annotation on image stream %s/%s: %v", lastTriggeredAnnotation, is.Namespace, is.Name, err))
+		}
+	}
+	return lastTriggered
+}
+
+// getUntriggeredTags returns the tags whose latest image has not triggered yet
+func getUntriggeredTags(is *imagev1.ImageStream, tags []string) []string {
+	lastTriggered := getLastTriggered(is)
+	untriggered := []string{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		latest := imageutil.LatestTaggedImage(is, tag)
+		if latest == nil || len(latest.Image) == 0 || lastTriggered[tag] == latest.Image {
+			continue
+		}
+		untriggered = append(untriggered, tag)
+	}
+	return untriggered
+}
+
+// recordTriggered records the image that triggered a tag on the image stream, keeping what is recorded for the
+// other tags.
+func (c *imageChangeController) recordTriggered(namespace, name, tag, image string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		is, err := c.imageClient.ImageV1().ImageStreams(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		lastTriggered := getLastTriggered(is)
+		lastTriggered[tag] = image
+		data, err := json.Marshal(lastTriggered)
+		if err != nil {
+			return err
+		}
+		if is.Annotations == nil {
+			is.Annotations = map[string]string{}
+		}
+		is.Annotations[lastTriggeredAnnotation] = string(data)
+		_, err = c.imageClient.ImageV1().ImageStreams(namespace).Update(is)
+		return err
+	})
+}
+
+// createPipelineRun instantiates the PipelineRun template with the new image reference as a parameter.  The
+// dynamic client is used so that obu does not need to depend on the Tekton API, and the API version comes from
+// the template itself.
+func (c *imageChangeController) createPipelineRun(is *imagev1.ImageStream, tag, img, templateName, param string) error {
+	cm, err := c.coreClient.CoreV1().ConfigMaps(is.Namespace).Get(templateName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("problem retrieving PipelineRun template config map %s: %v", templateName, err)
+	}
+	template, exists := cm.Data[pipelineRunTemplateKey]
+	if !exists {
+		return fmt.Errorf("PipelineRun template config map %s has no %s key", templateName, pipelineRunTemplateKey)
+	}
+	pipelineRun := &unstructured.Unstructured{}
+	if err := yaml.Unmarshal([]byte(template), &pipelineRun.Object); err != nil {
+		return fmt.Errorf("problem parsing PipelineRun template %s: %v", templateName, err)
+	}
+	gv, err := schema.ParseGroupVersion(pipelineRun.GetAPIVersion())
+	if err != nil || pipelineRun.GetKind() != "PipelineRun" {
+		return fmt.Errorf("template %s is not a PipelineRun", templateName)
+	}
+
+	pipelineRun.SetNamespace(is.Namespace)
+	if len(pipelineRun.GetName()) == 0 && len(pipelineRun.GetGenerateName()) == 0 {
+		pipelineRun.SetGenerateName(is.Name + "-")
+	}
+	labels := pipelineRun.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[triggerImageStreamLabel] = is.Name
+	labels[triggerTagLabel] = tag
+	pipelineRun.SetLabels(labels)
+
+	params, _, err := unstructured.NestedSlice(pipelineRun.Object, "spec", "params")
+	if err != nil {
+		return fmt.Errorf("template %s has invalid params: %v", templateName, err)
+	}
+	imageParam := map[string]interface{}{"name": param, "value": img}
+	replaced := false
+	for i, p := range params {
+		if existing, ok := p.(map[string]interface{}); ok && existing["name"] == param {
+			params[i] = imageParam
+			replaced = true
+		}
+	}
+	if !replaced {
+		params = append(params, imageParam)
+	}
+	if err := unstructured.SetNestedSlice(pipelineRun.Object, params, "spec", "params"); err != nil {
+		return err
+	}
+
+	gvr := gv.WithResource("pipelineruns")
+	created, err := c.dynamicClient.Resource(gvr).Namespace(is.Namespace).Create(pipelineRun, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("problem creating PipelineRun from template %s: %v", templateName, err)
+	}
+	fmt.Fprintf(os.Stdout, "created PipelineRun %s/%s for image stream tag %s:%s with %s=%s\n",
+		created.GetNamespace(), created.GetName(), is.Name, tag, param, img)
+	return nil
+}
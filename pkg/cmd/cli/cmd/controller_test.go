@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gabemontero/obu/pkg/api"
+	imagev1 "github.com/openshift/api/image/v1"
+	imagefake "github.com/openshift/client-go/image/clientset/versioned/fake"
+	imageinformers "github.com/openshift/client-go/image/informers/externalversions"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+const testPipelineRunTemplate = `apiVersion: tekton.dev/v1beta1
+kind: PipelineRun
+spec:
+  pipelineRef:
+    name: build
+  params:
+  - name: base-image
+    value: placeholder
+  - name: revision
+    value: main
+`
+
+func newTestTriggeredImageStream(annotations map[string]string) *imagev1.ImageStream {
+	return &imagev1.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Name: "mybase", Namespace: "demo", Annotations: annotations},
+		Status: imagev1.ImageStreamStatus{
+			DockerImageRepository: "image-registry.openshift-image-registry.svc:5000/demo/mybase",
+			Tags: []imagev1.NamedTagEventList{{
+				Tag: "latest",
+				Items: []imagev1.TagEvent{{
+					DockerImageReference: "quay.io/foo/base@sha256:aaaa",
+					Image:                "sha256:aaaa",
+					Generation:           1,
+				}},
+			}},
+		},
+	}
+}
+
+func startTestImageChangeController(t *testing.T, is *imagev1.ImageStream, stop <-chan struct{}) (*imageChangeController, *imagefake.Clientset, *dynamicfake.FakeDynamicClient) {
+	template := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "rebuild-mybase", Namespace: "demo"},
+		Data:       map[string]string{pipelineRunTemplateKey: testPipelineRunTemplate},
+	}
+	imageClient := imagefake.NewSimpleClientset(is)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	factory := imageinformers.NewSharedInformerFactoryWithOptions(imageClient, 0, imageinformers.WithNamespace("demo"))
+	c := newImageChangeController(&api.Config{}, kubefake.NewSimpleClientset(template), imageClient, dynamicClient, factory)
+	factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, c.synced) {
+		t.Fatalf("image stream cache did not sync")
+	}
+	return c, imageClient, dynamicClient
+}
+
+func getCreatedPipelineRuns(dynamicClient *dynamicfake.FakeDynamicClient) []*unstructured.Unstructured {
+	pipelineRuns := []*unstructured.Unstructured{}
+	for _, action := range dynamicClient.Actions() {
+		create, ok := action.(clienttesting.CreateAction)
+		if !ok || action.GetResource().Resource != "pipelineruns" {
+			continue
+		}
+		pipelineRuns = append(pipelineRuns, create.GetObject().(*unstructured.Unstructured))
+	}
+	return pipelineRuns
+}
+
+func TestImageChangeControllerCreatesPipelineRun(t *testing.T) {
+	is := newTestTriggeredImageStream(map[string]string{
+		triggerTemplateAnnotation: "rebuild-mybase",
+		triggerParamAnnotation:    "base-image",
+	})
+	expectedImage, err := translateImageStreamTag(&api.Config{}, is, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error translating the image stream tag: %v", err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	c, imageClient, dynamicClient := startTestImageChangeController(t, is, stop)
+
+	if err := c.sync("demo/mybase"); err != nil {
+		t.Fatalf("unexpected sync error: %v", err)
+	}
+	pipelineRuns := getCreatedPipelineRuns(dynamicClient)
+	if len(pipelineRuns) != 1 {
+		t.Fatalf("expected 1 PipelineRun to be created, got %d", len(pipelineRuns))
+	}
+	pipelineRun := pipelineRuns[0]
+	if pipelineRun.GetNamespace() != "demo" || pipelineRun.GetGenerateName() != "mybase-" {
+		t.Errorf("unexpected PipelineRun namespace %q and generate name %q", pipelineRun.GetNamespace(), pipelineRun.GetGenerateName())
+	}
+	if labels := pipelineRun.GetLabels(); labels[triggerImageStreamLabel] != "mybase" || labels[triggerTagLabel] != "latest" {
+		t.Errorf("unexpected PipelineRun labels %v", labels)
+	}
+	params, _, _ := unstructured.NestedSlice(pipelineRun.Object, "spec", "params")
+	expectedParams := map[string]string{"base-image": expectedImage, "revision": "main"}
+	if len(params) != len(expectedParams) {
+		t.Fatalf("expected params %v, got %v", expectedParams, params)
+	}
+	for _, p := range params {
+		param := p.(map[string]interface{})
+		if expectedParams[param["name"].(string)] != param["value"] {
+			t.Errorf("expected params %v, got %v", expectedParams, params)
+		}
+	}
+
+	updated, err := imageClient.ImageV1().ImageStreams("demo").Get("mybase", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error retrieving the image stream: %v", err)
+	}
+	if annotation := updated.Annotations[lastTriggeredAnnotation]; annotation != `{"latest":"sha256:aaaa"}` {
+		t.Errorf("unexpected %s annotation %q", lastTriggeredAnnotation, annotation)
+	}
+
+	// once the informer sees the recorded image, the same image does not trigger again
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		is, err := c.lister.ImageStreams("demo").Get("mybase")
+		return err == nil && len(is.Annotations[lastTriggeredAnnotation]) > 0, nil
+	})
+	if err != nil {
+		t.Fatalf("image stream update did not reach the informer: %v", err)
+	}
+	if err := c.sync("demo/mybase"); err != nil {
+		t.Fatalf("unexpected sync error: %v", err)
+	}
+	if pipelineRuns := getCreatedPipelineRuns(dynamicClient); len(pipelineRuns) != 1 {
+		t.Errorf("expected no further PipelineRuns for the same image, got %d in total", len(pipelineRuns))
+	}
+}
+
+func TestImageChangeControllerIgnoresUntriggeredImageStreams(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	c, imageClient, dynamicClient := startTestImageChangeController(t, newTestTriggeredImageStream(nil), stop)
+
+	if err := c.sync("demo/mybase"); err != nil {
+		t.Fatalf("unexpected sync error: %v", err)
+	}
+	if err := c.sync("demo/missing"); err != nil {
+		t.Fatalf("unexpected sync error for a deleted image stream: %v", err)
+	}
+	if len(dynamicClient.Actions()) != 0 {
+		t.Errorf("expected no PipelineRuns, got actions %v", dynamicClient.Actions())
+	}
+	for _, action := range imageClient.Actions() {
+		if action.GetVerb() == "update" {
+			t.Errorf("expected the image stream not to be updated, got %v", action)
+		}
+	}
+}
+
+func TestImageChangeControllerRetriesOnlyFailedTags(t *testing.T) {
+	is := newTestTriggeredImageStream(map[string]string{
+		triggerTemplateAnnotation: "rebuild-mybase",
+		triggerTagsAnnotation:     "latest,v2",
+	})
+	is.Status.Tags = append(is.Status.Tags, imagev1.NamedTagEventList{
+		Tag: "v2",
+		Items: []imagev1.TagEvent{{
+			DockerImageReference: "quay.io/foo/base@sha256:bbbb",
+			Image:                "sha256:bbbb",
+			Generation:           1,
+		}},
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	c, imageClient, dynamicClient := startTestImageChangeController(t, is, stop)
+
+	created := map[string]int{}
+	failV2 := true
+	dynamicClient.PrependReactor("create", "pipelineruns", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		pipelineRun := action.(clienttesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		tag := pipelineRun.GetLabels()[triggerTagLabel]
+		if tag == "v2" && failV2 {
+			failV2 = false
+			return true, nil, fmt.Errorf("injected failure")
+		}
+		created[tag]++
+		return true, pipelineRun, nil
+	})
+
+	if err := c.sync("demo/mybase"); err == nil {
+		t.Fatalf("expected the failed PipelineRun creation to be returned")
+	}
+	// the retry does not wait for the informer, whose copy of the image stream may not have the recorded image yet
+	if err := c.sync("demo/mybase"); err != nil {
+		t.Fatalf("unexpected sync error: %v", err)
+	}
+	if created["latest"] != 1 || created["v2"] != 1 {
+		t.Errorf("expected one PipelineRun per tag, got %v", created)
+	}
+	updated, err := imageClient.ImageV1().ImageStreams("demo").Get("mybase", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error retrieving the image stream: %v", err)
+	}
+	if annotation := updated.Annotations[lastTriggeredAnnotation]; annotation != `{"latest":"sha256:aaaa","v2":"sha256:bbbb"}` {
+		t.Errorf("unexpected %s annotation %q", lastTriggeredAnnotation, annotation)
+	}
+}
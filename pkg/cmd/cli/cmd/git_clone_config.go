@@ -0,0 +1,299 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+	buildv1 "github.com/openshift/api/build/v1"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/http/httpproxy"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// the keys of source secrets OpenShift builds read, beyond those of the basic-auth and ssh-auth secret types
+	sourceSecretCAKey         = "ca.crt"
+	sourceSecretGitConfigKey  = ".gitconfig"
+	sourceSecretKnownHostsKey = "known_hosts"
+
+	gitConfigFile        = ".gitconfig"
+	gitCredentialsFile   = ".git-credentials"
+	gitCABundleFile      = "ca-bundle.crt"
+	gitSourceConfigFile  = ".gitconfig-source"
+	gitSSHDir            = ".ssh"
+	gitSSHPrivateKeyFile = "ssh-privatekey"
+	gitSSHKnownHostsFile = "known_hosts"
+)
+
+// gitConfigSection is a section of a .gitconfig file, with its variables in the order they are written
+type gitConfigSection struct {
+	name      string
+	variables [][2]string
+}
+
+func NewCmdGitCloneConfig(cfg *api.Config) *cobra.Command {
+	gitCloneConfigCmd := &cobra.Command{
+		Use:   "git-clone-config [<buildconfig>] [<options>]",
+		Short: "Configure git to clone a build's source repository.",
+		Long: "Write a .gitconfig for cloning the git repository of a BuildConfig's source, or of --git-url, the way OpenShift\n" +
+			"builds clone it: through the proxy 'obu proxy --build-config' gives, unless the repository's host is in its\n" +
+			"no proxy list, trusting the cluster CA bundle, and with the credentials of the BuildConfig's source secret,\n" +
+			"or of --source-secret.  Username and password (or token) secrets are written to a git credential store, SSH\n" +
+			"keys and known hosts are used through core.sshCommand, and the ca.crt and .gitconfig keys of the secret are\n" +
+			"honored too.  All of the files are written to the output directory, with the credentials readable by their\n" +
+			"owner only, and the path of the .gitconfig is printed.",
+		Example: `
+# Clone the source of the 'myapp' BuildConfig in a Tekton step
+$ export GIT_CONFIG_GLOBAL=$(obu git-clone-config myapp --output-dir $(workspaces.git-config.path))
+$ git clone https://github.com/example/myapp.git $(workspaces.source.path)
+
+# Write the configuration for a repository and a kubernetes.io/ssh-auth secret, then clone it with git versions
+# that predate GIT_CONFIG_GLOBAL
+$ obu git-clone-config --git-url git@github.com:example/myapp.git --source-secret github-ssh --output-dir /tmp/git
+$ HOME=/tmp/git git clone git@github.com:example/myapp.git
+`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			clients, err := util.GetClients(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem with kubeconfig: %v\n", err)
+				return
+			}
+			namespace, err := util.GetNamespace(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			repoURL, secretName := cfg.GitURL, cfg.SourceSecret
+			var bc *buildv1.BuildConfig
+			if len(args) > 0 {
+				bc, err = clients.Build.BuildV1().BuildConfigs(namespace).Get(args[0], metav1.GetOptions{})
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: problem retrieving build config %s: %v\n", args[0], err)
+					return
+				}
+				if bc.Spec.Source.Git == nil {
+					fmt.Fprintf(os.Stderr, "ERROR: build config %s does not have a git source\n", bc.Name)
+					return
+				}
+				if len(repoURL) == 0 {
+					repoURL = bc.Spec.Source.Git.URI
+				}
+				if len(secretName) == 0 && bc.Spec.Source.SourceSecret != nil {
+					secretName = bc.Spec.Source.SourceSecret.Name
+				}
+			}
+			if len(repoURL) == 0 {
+				fmt.Fprintf(os.Stderr, "ERROR: either a build config or --git-url is required\n")
+				return
+			}
+			dir, err := filepath.Abs(util.GetTektonOutputFile(cfg.GitConfigDir, util.TektonWorkspaceDir))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			gitConfigPath, err := writeGitCloneConfig(clients, namespace, bc, repoURL, secretName, dir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			fmt.Fprintf(os.Stdout, "%s\n", gitConfigPath)
+		},
+	}
+	gitCloneConfigCmd.Flags().StringVar(&(cfg.GitURL), "git-url", cfg.GitURL,
+		"The URL of the git repository to clone, instead of that of the build config's source.")
+	gitCloneConfigCmd.Flags().StringVar(&(cfg.SourceSecret), "source-secret", cfg.SourceSecret,
+		"The secret with the credentials for the git repository, instead of the build config's source secret.")
+	gitCloneConfigCmd.Flags().StringVar(&(cfg.GitConfigDir), "output-dir", ".",
+		"The directory to write the .gitconfig and the files it refers to in.  In a Tekton step, relative paths are under /workspace.")
+	return gitCloneConfigCmd
+}
+
+// writeGitCloneConfig writes the .gitconfig for cloning the repository, along with the files it refers to, to dir,
+// returning its path.  The git proxy settings of the build config, when given, take precedence over the cluster's.
+func writeGitCloneConfig(clients *util.Clients, namespace string, bc *buildv1.BuildConfig, repoURL, secretName, dir string) (string, error) {
+	parsed, isSSH, err := parseGitURL(repoURL)
+	if err != nil {
+		return "", err
+	}
+	var secret *corev1.Secret
+	if len(secretName) > 0 {
+		secret, err = clients.Core.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("problem retrieving source secret %s: %v", secretName, err)
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("problem creating %s: %v", dir, err)
+	}
+
+	httpSection := &gitConfigSection{name: "http"}
+	sections := []*gitConfigSection{httpSection}
+	caBundle := ""
+	// the proxy only matters to the http transport, git does not send ssh through it
+	if !isSSH {
+		proxy, err := getEffectiveProxy(clients, bc, true)
+		if err != nil {
+			return "", err
+		}
+		proxyFunc := (&httpproxy.Config{
+			HTTPProxy:  proxy.HTTPProxy.Value,
+			HTTPSProxy: proxy.HTTPSProxy.Value,
+			NoProxy:    proxy.NoProxy.Value,
+		}).ProxyFunc()
+		proxyURL, err := proxyFunc(parsed)
+		if err != nil {
+			return "", fmt.Errorf("problem with the proxy configuration: %v", err)
+		}
+		if proxyURL != nil {
+			httpSection.variables = append(httpSection.variables, [2]string{"proxy", proxyURL.String()})
+		}
+		if proxyCAData, err := getGlobalProxyCAData(clients); err == nil {
+			caBundle += ensureTrailingNewline(proxyCAData)
+		} else {
+			fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+		}
+	}
+
+	if secret != nil {
+		if len(secret.Data[sourceSecretCAKey]) > 0 {
+			if isSSH {
+				fmt.Fprintf(os.Stderr, "WARNING: the %s of source secret %s is not used for %s, which is cloned over ssh\n", sourceSecretCAKey, secret.Name, repoURL)
+			}
+			caBundle += ensureTrailingNewline(string(secret.Data[sourceSecretCAKey]))
+		}
+		switch {
+		case len(secret.Data[corev1.SSHAuthPrivateKey]) > 0:
+			if !isSSH {
+				fmt.Fprintf(os.Stderr, "WARNING: source secret %s holds an SSH key, which is not used for %s\n", secret.Name, repoURL)
+			}
+			sshCommand, err := writeGitSSHFiles(secret, dir)
+			if err != nil {
+				return "", err
+			}
+			sections = append(sections, &gitConfigSection{name: "core", variables: [][2]string{{"sshCommand", sshCommand}}})
+		case len(secret.Data[corev1.BasicAuthPasswordKey]) > 0:
+			if isSSH {
+				fmt.Fprintf(os.Stderr, "WARNING: source secret %s holds a password or token, which is not used for %s\n", secret.Name, repoURL)
+			}
+			credentialsPath := filepath.Join(dir, gitCredentialsFile)
+			credentials := &url.URL{
+				Scheme: parsed.Scheme,
+				Host:   parsed.Host,
+				User: url.UserPassword(string(secret.Data[corev1.BasicAuthUsernameKey]),
+					string(secret.Data[corev1.BasicAuthPasswordKey])),
+			}
+			if err := writeCredentialsFile(credentialsPath, credentials.String()+"\n"); err != nil {
+				return "", err
+			}
+			sections = append(sections, &gitConfigSection{name: "credential", variables: [][2]string{
+				{"helper", "store --file=" + credentialsPath},
+			}})
+		case len(secret.Data[sourceSecretCAKey]) == 0 && len(secret.Data[sourceSecretGitConfigKey]) == 0:
+			return "", fmt.Errorf("source secret %s has none of the %s, %s, %s or %s keys", secret.Name,
+				corev1.BasicAuthPasswordKey, corev1.SSHAuthPrivateKey, sourceSecretCAKey, sourceSecretGitConfigKey)
+		}
+		// the secret's own configuration is included last, so that it takes precedence like it does in builds
+		if len(secret.Data[sourceSecretGitConfigKey]) > 0 {
+			sourceConfigPath := filepath.Join(dir, gitSourceConfigFile)
+			if err := writeCredentialsFile(sourceConfigPath, string(secret.Data[sourceSecretGitConfigKey])); err != nil {
+				return "", err
+			}
+			sections = append(sections, &gitConfigSection{name: "include", variables: [][2]string{{"path", sourceConfigPath}}})
+		}
+	}
+
+	if len(caBundle) > 0 {
+		caBundlePath := filepath.Join(dir, gitCABundleFile)
+		if err := ioutil.WriteFile(caBundlePath, []byte(caBundle), 0644); err != nil {
+			return "", fmt.Errorf("problem writing %s: %v", caBundlePath, err)
+		}
+		httpSection.variables = append(httpSection.variables, [2]string{"sslCAInfo", caBundlePath})
+	}
+
+	gitConfigPath := filepath.Join(dir, gitConfigFile)
+	if err := ioutil.WriteFile(gitConfigPath, []byte(formatGitConfig(sections)), 0644); err != nil {
+		return "", fmt.Errorf("problem writing %s: %v", gitConfigPath, err)
+	}
+	return gitConfigPath, nil
+}
+
+// writeGitSSHFiles writes the private key and known hosts of an ssh-auth secret, returning the ssh command that uses
+// them.  Like OpenShift builds, host keys are only checked when the secret has known hosts.
+func writeGitSSHFiles(secret *corev1.Secret, dir string) (string, error) {
+	sshDir := filepath.Join(dir, gitSSHDir)
+	if err := os.MkdirAll(sshDir, 0700); err != nil {
+		return "", fmt.Errorf("problem creating %s: %v", sshDir, err)
+	}
+	keyPath := filepath.Join(sshDir, gitSSHPrivateKeyFile)
+	if err := writeCredentialsFile(keyPath, ensureTrailingNewline(string(secret.Data[corev1.SSHAuthPrivateKey]))); err != nil {
+		return "", err
+	}
+	sshCommand := "ssh -i " + shellQuote(keyPath) + " -o IdentitiesOnly=yes"
+	if knownHosts := secret.Data[sourceSecretKnownHostsKey]; len(knownHosts) > 0 {
+		knownHostsPath := filepath.Join(sshDir, gitSSHKnownHostsFile)
+		if err := ioutil.WriteFile(knownHostsPath, knownHosts, 0644); err != nil {
+			return "", fmt.Errorf("problem writing %s: %v", knownHostsPath, err)
+		}
+		return sshCommand + " -o UserKnownHostsFile=" + shellQuote(knownHostsPath) + " -o StrictHostKeyChecking=yes", nil
+	}
+	fmt.Fprintf(os.Stderr, "WARNING: source secret %s has no %s, so the git server's host key is not checked\n", secret.Name, sourceSecretKnownHostsKey)
+	return sshCommand + " -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no", nil
+}
+
+// parseGitURL parses the URL forms git accepts, returning whether it is cloned over ssh, including the scp-like
+// [user@]host:path form.
+func parseGitURL(repoURL string) (*url.URL, bool, error) {
+	if !strings.Contains(repoURL, "://") {
+		if i := strings.Index(repoURL, ":"); i > 0 && !strings.Contains(repoURL[:i], "/") {
+			host := repoURL[:i]
+			if at := strings.LastIndex(host, "@"); at >= 0 {
+				host = host[at+1:]
+			}
+			return &url.URL{Scheme: "ssh", Host: host, Path: repoURL[i+1:]}, true, nil
+		}
+		return nil, false, fmt.Errorf("%s is not a remote git repository URL", repoURL)
+	}
+	parsed, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid git repository URL %s: %v", repoURL, err)
+	}
+	switch parsed.Scheme {
+	case "http", "https":
+		return parsed, false, nil
+	case "ssh", "git+ssh", "ssh+git":
+		return parsed, true, nil
+	}
+	return nil, false, fmt.Errorf("unsupported git repository URL scheme %q, use http(s) or ssh", parsed.Scheme)
+}
+
+// formatGitConfig writes the sections in git config syntax, leaving out empty ones, and quoting the values so that
+// characters like '#' and ';' are not taken as the start of a comment.
+func formatGitConfig(sections []*gitConfigSection) string {
+	out := &strings.Builder{}
+	for _, section := range sections {
+		if len(section.variables) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "[%s]\n", section.name)
+		for _, variable := range section.variables {
+			value := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(variable[1])
+			fmt.Fprintf(out, "\t%s = \"%s\"\n", variable[0], value)
+		}
+	}
+	return out.String()
+}
+
+func ensureTrailingNewline(s string) string {
+	if len(s) > 0 && !strings.HasSuffix(s, "\n") {
+		return s + "\n"
+	}
+	return s
+}
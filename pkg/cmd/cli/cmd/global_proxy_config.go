@@ -4,16 +4,36 @@ import (
 	"fmt"
 	"github.com/gabemontero/obu/pkg/api"
 	"github.com/gabemontero/obu/pkg/util"
+	buildv1 "github.com/openshift/api/build/v1"
+	configv1 "github.com/openshift/api/config/v1"
 	"github.com/spf13/cobra"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"os"
 )
 
+// proxyValue is a proxy setting along with the field of the layer of configuration it was taken from
+type proxyValue struct {
+	Value  string
+	Source string
+}
+
+// effectiveProxy is the proxy configuration a build ends up with
+type effectiveProxy struct {
+	HTTPProxy  proxyValue
+	HTTPSProxy proxyValue
+	NoProxy    proxyValue
+}
+
 func NewCmdGlobalProxyConfig(cfg *api.Config) *cobra.Command {
 	proxyCmd := &cobra.Command{
 		Use:   "proxy [<options>]",
 		Short: "Access OpenShift global proxy configuration.",
-		Long:  "Pull the various elements from OpenShift's global proxy configuration support.",
+		Long: "Pull the various elements from OpenShift's global proxy configuration support.  The proxy settings are those\n" +
+			"OpenShift builds use: the build defaults of the cluster's Build config take precedence over the global\n" +
+			"proxy, and with --build-config, the settings for cloning the build config's git source are given, where its\n" +
+			"own git proxy fields, then the git proxy of the build defaults, take precedence.  --explain lists which of\n" +
+			"these each setting comes from.",
 		Example: `
 # List all three proxy related settings as if you were setting environment variables, where the hosts
 # are listed if they have been successfully contacted by the global proxy operator
@@ -27,60 +47,68 @@ $ obu proxy --http-proxy-only
 
 # List only the no proxy host list
 $ obu proxy --no-proxy-only
+
+# List the proxy settings for cloning the source of the 'myapp' build config, and where each one comes from
+$ obu proxy --build-config myapp --explain
 `,
 		Run: func(cmd *cobra.Command, args []string) {
 
-			kubeconfig, err := util.GetConfig(cfg)
+			clients, err := util.GetClients(cfg)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "ERROR: problem with kubeconfig: %v\n", err)
 				return
 			}
-			proxyClient := util.GetProxyClient(kubeconfig)
-			proxyCfg, err := proxyClient.Get("cluster", metav1.GetOptions{})
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "ERROR: problem retrieving openshift global proxy config: %v\n", err)
-				return
+			var bc *buildv1.BuildConfig
+			if len(cfg.BuildConfig) > 0 {
+				namespace, err := util.GetNamespace(cfg)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+					return
+				}
+				bc, err = clients.Build.BuildV1().BuildConfigs(namespace).Get(cfg.BuildConfig, metav1.GetOptions{})
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: problem retrieving build config %s: %v\n", cfg.BuildConfig, err)
+					return
+				}
 			}
-			if proxyCfg == nil {
-				fmt.Fprintf(os.Stderr, "ERROR: problem retrieving openshift global proxy config: no error but nil reference\n")
-				return
-			}
-
-			coreClient := util.GetCoreClient(kubeconfig)
-			//TODO alternatively, we could allow for a creation of a CM in the specified namespace that has
-			// the label 'config.openshift.io/inject-trusted-cabundle: "true"'
-			ocmProxyCM, err := coreClient.CoreV1().ConfigMaps("openshift-controller-manager").Get(
-				"openshift-global-ca", metav1.GetOptions{})
+			proxy, err := getEffectiveProxy(clients, bc, bc != nil)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "ERROR: problem retrieving OCM globly proxy CA config map: %v\n", err)
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
 				return
 			}
-			if ocmProxyCM == nil || len(ocmProxyCM.Data) == 0 {
-				fmt.Fprintf(os.Stderr, "ERROR: proxy CA data is not available\n")
-				return
-			}
-			globalCAData, exists := ocmProxyCM.Data["ca-bundle.crt"]
-			if !exists {
-				fmt.Fprintf(os.Stderr, "ERROR: proxy CA data has not been set\n")
+			globalCAData, err := getGlobalProxyCAData(clients)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
 				return
 			}
 
 			switch {
 			case cfg.HttpsProxyOnly:
-				fmt.Fprintf(os.Stdout, proxyCfg.Status.HTTPSProxy)
+				fmt.Fprintf(os.Stdout, proxy.HTTPSProxy.Value)
 			case cfg.HttpProxyOnly:
-				fmt.Fprintf(os.Stdout, proxyCfg.Status.HTTPProxy)
+				fmt.Fprintf(os.Stdout, proxy.HTTPProxy.Value)
 			case cfg.NoProxyOnly:
-				fmt.Fprintf(os.Stdout, proxyCfg.Status.NoProxy)
+				fmt.Fprintf(os.Stdout, proxy.NoProxy.Value)
 			case cfg.CADataOnly:
 				fmt.Fprintf(os.Stdout, globalCAData)
 			case cfg.ENVVarsOnly:
-				fmt.Fprintf(os.Stdout, "HTTPS_PROXY=%s\n", proxyCfg.Status.HTTPSProxy)
-				fmt.Fprintf(os.Stdout, "HTTP_PROXY=%s\n", proxyCfg.Status.HTTPProxy)
-				fmt.Fprintf(os.Stdout, "NO_PROXY=%s\n", proxyCfg.Status.NoProxy)
-				fmt.Fprintf(os.Stdout, "https_proxy=%s\n", proxyCfg.Status.HTTPSProxy)
-				fmt.Fprintf(os.Stdout, "http_proxy=%s\n", proxyCfg.Status.HTTPProxy)
-				fmt.Fprintf(os.Stdout, "no_proxy=%s\n", proxyCfg.Status.NoProxy)
+				fmt.Fprintf(os.Stdout, "HTTPS_PROXY=%s\n", proxy.HTTPSProxy.Value)
+				fmt.Fprintf(os.Stdout, "HTTP_PROXY=%s\n", proxy.HTTPProxy.Value)
+				fmt.Fprintf(os.Stdout, "NO_PROXY=%s\n", proxy.NoProxy.Value)
+				fmt.Fprintf(os.Stdout, "https_proxy=%s\n", proxy.HTTPSProxy.Value)
+				fmt.Fprintf(os.Stdout, "http_proxy=%s\n", proxy.HTTPProxy.Value)
+				fmt.Fprintf(os.Stdout, "no_proxy=%s\n", proxy.NoProxy.Value)
+			case cfg.Explain:
+				for _, setting := range []struct {
+					name  string
+					value proxyValue
+				}{
+					{"HTTPS_PROXY", proxy.HTTPSProxy},
+					{"HTTP_PROXY", proxy.HTTPProxy},
+					{"NO_PROXY", proxy.NoProxy},
+				} {
+					fmt.Fprintf(os.Stdout, "%s=%s\t# %s\n", setting.name, setting.value.Value, setting.value.Source)
+				}
 			default:
 				util.DefaultMessage()
 			}
@@ -89,7 +117,7 @@ $ obu proxy --no-proxy-only
 
 	proxyCmd.Flags().BoolVar(&(cfg.HttpProxyOnly), "http-proxy", cfg.HttpProxyOnly,
 		"Only list the HTTP proxy host if it is available.")
-	proxyCmd.Flags().BoolVar(&(cfg.HttpProxyOnly), "https-proxy", cfg.HttpProxyOnly,
+	proxyCmd.Flags().BoolVar(&(cfg.HttpsProxyOnly), "https-proxy", cfg.HttpsProxyOnly,
 		"Only list the HTTPS proxy host if it is available.")
 	proxyCmd.Flags().BoolVar(&(cfg.NoProxyOnly), "no-proxy", cfg.NoProxyOnly,
 		"Only list the no proxy list if it is available.")
@@ -97,6 +125,114 @@ $ obu proxy --no-proxy-only
 		"Prints out bash style environment variable setting syntax for the well known proxy environment variables, using any available values.")
 	proxyCmd.Flags().BoolVar(&(cfg.CADataOnly), "ca-data", cfg.CADataOnly,
 		"Only list the raw CA CRT data (ca.crt contents) for accessing the HTTPS proxy.")
+	proxyCmd.Flags().BoolVar(&(cfg.Explain), "explain", cfg.Explain,
+		"List the proxy settings along with the build config, build defaults or global proxy field each one comes from.")
+	proxyCmd.Flags().StringVar(&(cfg.BuildConfig), "build-config", cfg.BuildConfig,
+		"Give the proxy settings for cloning the git source of this build config, as opposed to those of the build as a whole.")
 
 	return proxyCmd
 }
+
+func getGlobalProxyConfig(clients *util.Clients) (*configv1.Proxy, error) {
+	proxyCfg, err := clients.Config.ConfigV1().Proxies().Get("cluster", metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("problem retrieving openshift global proxy config: %v", err)
+	}
+	if proxyCfg == nil {
+		return nil, fmt.Errorf("problem retrieving openshift global proxy config: no error but nil reference")
+	}
+	return proxyCfg, nil
+}
+
+// getEffectiveProxy computes the proxy settings the way OpenShift builds do.  The default proxy of the cluster's build
+// defaults replaces the global proxy as a whole when set.  For git, each setting of the git proxy of the build
+// defaults takes precedence over the default proxy, and each git proxy field set on the build config, even to an
+// empty value, over both.  Without access to the build config, the global proxy is used.
+func getEffectiveProxy(clients *util.Clients, bc *buildv1.BuildConfig, git bool) (*effectiveProxy, error) {
+	proxy := &effectiveProxy{
+		HTTPProxy:  proxyValue{Source: "unset"},
+		HTTPSProxy: proxyValue{Source: "unset"},
+		NoProxy:    proxyValue{Source: "unset"},
+	}
+	buildCfg, err := clients.Config.ConfigV1().Builds().Get("cluster", metav1.GetOptions{})
+	switch {
+	case kerrors.IsNotFound(err):
+		buildCfg = &configv1.Build{}
+	case kerrors.IsForbidden(err):
+		fmt.Fprintf(os.Stderr, "WARNING: not allowed to read the build defaults of openshift build config cluster, using the global proxy: %v\n", err)
+		buildCfg = &configv1.Build{}
+	case err != nil:
+		return nil, fmt.Errorf("problem retrieving openshift build config: %v", err)
+	}
+	defaults := buildCfg.Spec.BuildDefaults
+
+	if defaults.DefaultProxy != nil {
+		setProxyValues(proxy, defaults.DefaultProxy, "build defaults spec.buildDefaults.defaultProxy")
+	} else {
+		proxyCfg, err := getGlobalProxyConfig(clients)
+		if err != nil {
+			return nil, err
+		}
+		setProxyValues(proxy, &configv1.ProxySpec{
+			HTTPProxy:  proxyCfg.Status.HTTPProxy,
+			HTTPSProxy: proxyCfg.Status.HTTPSProxy,
+			NoProxy:    proxyCfg.Status.NoProxy,
+		}, "global proxy status")
+	}
+	if !git {
+		return proxy, nil
+	}
+	if defaults.GitProxy != nil {
+		setProxyValues(proxy, defaults.GitProxy, "build defaults spec.buildDefaults.gitProxy")
+	}
+	if bc != nil && bc.Spec.Source.Git != nil {
+		source := "build config " + bc.Name + " spec.source.git"
+		for _, field := range []struct {
+			value *string
+			into  *proxyValue
+			name  string
+		}{
+			{bc.Spec.Source.Git.HTTPProxy, &proxy.HTTPProxy, "httpProxy"},
+			{bc.Spec.Source.Git.HTTPSProxy, &proxy.HTTPSProxy, "httpsProxy"},
+			{bc.Spec.Source.Git.NoProxy, &proxy.NoProxy, "noProxy"},
+		} {
+			if field.value != nil {
+				*field.into = proxyValue{Value: *field.value, Source: source + "." + field.name}
+			}
+		}
+	}
+	return proxy, nil
+}
+
+// setProxyValues overrides the settings of proxy with those that are set in spec
+func setProxyValues(proxy *effectiveProxy, spec *configv1.ProxySpec, source string) {
+	if len(spec.HTTPProxy) > 0 {
+		proxy.HTTPProxy = proxyValue{Value: spec.HTTPProxy, Source: source + ".httpProxy"}
+	}
+	if len(spec.HTTPSProxy) > 0 {
+		proxy.HTTPSProxy = proxyValue{Value: spec.HTTPSProxy, Source: source + ".httpsProxy"}
+	}
+	if len(spec.NoProxy) > 0 {
+		proxy.NoProxy = proxyValue{Value: spec.NoProxy, Source: source + ".noProxy"}
+	}
+}
+
+// getGlobalProxyCAData returns the trusted CA bundle the global proxy operator injects for OCM, which includes the
+// CAs of the proxies.
+func getGlobalProxyCAData(clients *util.Clients) (string, error) {
+	//TODO alternatively, we could allow for a creation of a CM in the specified namespace that has
+	// the label 'config.openshift.io/inject-trusted-cabundle: "true"'
+	ocmProxyCM, err := clients.Core.CoreV1().ConfigMaps("openshift-controller-manager").Get(
+		"openshift-global-ca", metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("problem retrieving OCM globly proxy CA config map: %v", err)
+	}
+	if ocmProxyCM == nil || len(ocmProxyCM.Data) == 0 {
+		return "", fmt.Errorf("proxy CA data is not available")
+	}
+	globalCAData, exists := ocmProxyCM.Data["ca-bundle.crt"]
+	if !exists {
+		return "", fmt.Errorf("proxy CA data has not been set")
+	}
+	return globalCAData, nil
+}
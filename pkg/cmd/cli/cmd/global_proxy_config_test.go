@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/gabemontero/obu/pkg/util"
+	configv1 "github.com/openshift/api/config/v1"
+	configfake "github.com/openshift/client-go/config/clientset/versioned/fake"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestGetEffectiveProxy(t *testing.T) {
+	globalProxy := &configv1.Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+		Status:     configv1.ProxyStatus{HTTPProxy: "http://proxy:3128"},
+	}
+	buildDefaults := &configv1.Build{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+		Spec: configv1.BuildSpec{BuildDefaults: configv1.BuildDefaults{
+			DefaultProxy: &configv1.ProxySpec{HTTPProxy: "http://build-proxy:3128"},
+		}},
+	}
+	tests := []struct {
+		name      string
+		objects   []runtime.Object
+		forbidden bool
+		expected  string
+	}{
+		{name: "global proxy", objects: []runtime.Object{globalProxy}, expected: "http://proxy:3128"},
+		{name: "build default proxy", objects: []runtime.Object{globalProxy, buildDefaults}, expected: "http://build-proxy:3128"},
+		{name: "build config forbidden", objects: []runtime.Object{globalProxy, buildDefaults}, forbidden: true, expected: "http://proxy:3128"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configClient := configfake.NewSimpleClientset(test.objects...)
+			if test.forbidden {
+				configClient.PrependReactor("get", "builds", func(action clienttesting.Action) (bool, runtime.Object, error) {
+					return true, nil, kerrors.NewForbidden(schema.GroupResource{Group: "config.openshift.io", Resource: "builds"}, "cluster", nil)
+				})
+			}
+			proxy, err := getEffectiveProxy(&util.Clients{Config: configClient}, nil, false)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if proxy.HTTPProxy.Value != test.expected {
+				t.Errorf("expected HTTP proxy %s, got %#v", test.expected, proxy.HTTPProxy)
+			}
+		})
+	}
+}
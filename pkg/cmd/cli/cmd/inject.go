@@ -0,0 +1,301 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+	buildv1 "github.com/openshift/api/build/v1"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// injectManifestFile records what inject created, relative to the directory it injected into
+const injectManifestFile = ".obu-inject.json"
+
+// injectManifest lists the files and directories inject created, so that cleanup removes those and nothing else
+type injectManifest struct {
+	BuildConfig string   `json:"buildConfig"`
+	Files       []string `json:"files"`
+	Directories []string `json:"directories,omitempty"`
+}
+
+// injectedFile is the contents of a key of a build source secret or config map
+type injectedFile struct {
+	path     string
+	contents []byte
+	mode     os.FileMode
+}
+
+func NewCmdInject(cfg *api.Config) *cobra.Command {
+	injectCmd := &cobra.Command{
+		Use:   "inject <buildconfig> [<options>]",
+		Short: "Copy the secrets and config maps of a BuildConfig's source into a source checkout.",
+		Long: "Copy the keys of the secrets and config maps a BuildConfig's source lists into their destination directories,\n" +
+			"relative to the source's context directory, the way OpenShift builds copy them into the build directory.\n" +
+			"Secret files are only readable by their owner.  What is created is recorded in a " + injectManifestFile + " file,\n" +
+			"and --cleanup removes exactly that afterwards, leaving the checkout as it was.  Files that already exist in the\n" +
+			"checkout are not overwritten.  Unlike Source strategy builds, injected files are not truncated once the\n" +
+			"assemble script finishes, so clean up before the image is committed if it copies the source.",
+		Example: `
+# Inject the build inputs of the 'myapp' BuildConfig into the source checked out in a Tekton workspace
+$ obu inject myapp --dir $(workspaces.source.path)
+
+# Remove them again, i.e. in a finally Task
+$ obu inject --cleanup --dir $(workspaces.source.path)
+`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			dir := util.GetTektonOutputFile(cfg.InjectDir, util.TektonWorkspaceDir)
+			if cfg.Cleanup {
+				if len(args) > 0 {
+					fmt.Fprintf(os.Stderr, "ERROR: --cleanup only uses the %s file, and does not take a build config\n", injectManifestFile)
+					return
+				}
+				if err := cleanupInjected(dir); err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				}
+				return
+			}
+			if len(args) == 0 {
+				fmt.Fprintf(os.Stderr, "ERROR: the build config to inject the secrets and config maps of is required\n")
+				return
+			}
+			clients, err := util.GetClients(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem with kubeconfig: %v\n", err)
+				return
+			}
+			namespace, err := util.GetNamespace(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			bc, err := clients.Build.BuildV1().BuildConfigs(namespace).Get(args[0], metav1.GetOptions{})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem retrieving build config %s: %v\n", args[0], err)
+				return
+			}
+			files, err := getInjectedFiles(clients, bc)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			if err := injectFiles(dir, bc.Name, files); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			for _, file := range files {
+				fmt.Fprintf(os.Stdout, "%s\n", file.path)
+			}
+		},
+	}
+	injectCmd.Flags().StringVar(&(cfg.InjectDir), "dir", ".",
+		"The directory the build config's source is checked out in.  In a Tekton step, relative paths are under /workspace.")
+	injectCmd.Flags().BoolVar(&(cfg.Cleanup), "cleanup", cfg.Cleanup,
+		"Remove what a previous inject created in the directory, as recorded in its "+injectManifestFile+" file.")
+	return injectCmd
+}
+
+// getInjectedFiles reads the secrets and config maps of the build config's source, returning a file for each of their
+// keys, with paths relative to the source checkout.
+func getInjectedFiles(clients *util.Clients, bc *buildv1.BuildConfig) ([]injectedFile, error) {
+	source := bc.Spec.Source
+	files := []injectedFile{}
+	for _, secretSource := range source.Secrets {
+		dir, err := getInjectDestination(source.ContextDir, secretSource.DestinationDir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination for secret %s: %v", secretSource.Secret.Name, err)
+		}
+		secret, err := clients.Core.CoreV1().Secrets(bc.Namespace).Get(secretSource.Secret.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("problem retrieving secret %s: %v", secretSource.Secret.Name, err)
+		}
+		for key, value := range secret.Data {
+			files = append(files, injectedFile{path: filepath.Join(dir, key), contents: value, mode: 0600})
+		}
+	}
+	for _, cmSource := range source.ConfigMaps {
+		dir, err := getInjectDestination(source.ContextDir, cmSource.DestinationDir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination for config map %s: %v", cmSource.ConfigMap.Name, err)
+		}
+		cm, err := clients.Core.CoreV1().ConfigMaps(bc.Namespace).Get(cmSource.ConfigMap.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("problem retrieving config map %s: %v", cmSource.ConfigMap.Name, err)
+		}
+		for key, value := range cm.Data {
+			files = append(files, injectedFile{path: filepath.Join(dir, key), contents: []byte(value), mode: 0644})
+		}
+		for key, value := range cm.BinaryData {
+			files = append(files, injectedFile{path: filepath.Join(dir, key), contents: value, mode: 0644})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	for i := 1; i < len(files); i++ {
+		if files[i].path == files[i-1].path {
+			return nil, fmt.Errorf("more than one secret or config map key is injected as %s", files[i].path)
+		}
+	}
+	return files, nil
+}
+
+// getInjectDestination validates a destination directory the way the API server does, as staying within the build
+// directory, and returns it relative to the source checkout.
+func getInjectDestination(contextDir, destinationDir string) (string, error) {
+	if filepath.IsAbs(destinationDir) {
+		return "", fmt.Errorf("%s must be a relative path", destinationDir)
+	}
+	dir := filepath.Join(contextDir, destinationDir)
+	if dir == ".." || strings.HasPrefix(dir, "../") {
+		return "", fmt.Errorf("%s must not point outside of the source", destinationDir)
+	}
+	return dir, nil
+}
+
+// injectFiles writes the files under dir, recording them, and any directories created for them, in the manifest.
+// Nothing is written when any of the files already exists.
+func injectFiles(dir, buildConfig string, files []injectedFile) error {
+	manifestPath := filepath.Join(dir, injectManifestFile)
+	if _, err := os.Stat(manifestPath); err == nil {
+		return fmt.Errorf("%s already has injected files, remove them with --cleanup first", dir)
+	}
+	for _, file := range files {
+		if err := checkInjectPath(dir, file.path); err != nil {
+			return err
+		}
+		if _, err := os.Lstat(filepath.Join(dir, file.path)); err == nil {
+			return fmt.Errorf("%s already exists in %s", file.path, dir)
+		}
+	}
+
+	manifest := &injectManifest{BuildConfig: buildConfig, Files: []string{}}
+	// the manifest is saved whatever happens, so that --cleanup can undo a partial injection
+	defer func() {
+		data, _ := json.MarshalIndent(manifest, "", "  ")
+		if err := ioutil.WriteFile(manifestPath, data, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: problem writing %s: %v\n", manifestPath, err)
+		}
+	}()
+	for _, file := range files {
+		created, err := mkdirAllRecorded(dir, filepath.Dir(file.path))
+		manifest.Directories = append(manifest.Directories, created...)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, file.path)
+		if err := ioutil.WriteFile(path, file.contents, file.mode); err != nil {
+			return fmt.Errorf("problem writing %s: %v", path, err)
+		}
+		manifest.Files = append(manifest.Files, file.path)
+		if err := os.Chmod(path, file.mode); err != nil {
+			return fmt.Errorf("problem setting permissions of %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// checkInjectPath refuses a path relative to dir that is absolute, points outside of dir or goes through a symbolic
+// link, so that neither injecting nor cleaning up touches files elsewhere.
+func checkInjectPath(dir, rel string) error {
+	if filepath.IsAbs(rel) {
+		return fmt.Errorf("%s must be a relative path", rel)
+	}
+	rel = filepath.Clean(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("%s must not point outside of %s", rel, dir)
+	}
+	current := dir
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if part == "." {
+			continue
+		}
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symbolic link", current)
+		}
+	}
+	return nil
+}
+
+// mkdirAllRecorded creates the directory rel under dir along with its missing parents, returning those it created,
+// parents first.  Symbolic links are not followed.
+func mkdirAllRecorded(dir, rel string) ([]string, error) {
+	created := []string{}
+	current := ""
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if part == "." || len(part) == 0 {
+			continue
+		}
+		current = filepath.Join(current, part)
+		path := filepath.Join(dir, current)
+		if info, err := os.Lstat(path); err == nil {
+			if info.Mode()&os.ModeSymlink != 0 {
+				return created, fmt.Errorf("%s is a symbolic link", path)
+			}
+			if !info.IsDir() {
+				return created, fmt.Errorf("%s is not a directory", path)
+			}
+			continue
+		}
+		if err := os.Mkdir(path, 0755); err != nil {
+			return created, fmt.Errorf("problem creating %s: %v", path, err)
+		}
+		created = append(created, current)
+	}
+	return created, nil
+}
+
+// cleanupInjected removes the files and directories recorded in the manifest under dir, then the manifest itself.
+// Directories that are no longer empty, because the build added to them, are left in place.  Nothing is removed when
+// the manifest lists a path outside of dir or through a symbolic link.
+func cleanupInjected(dir string) error {
+	manifestPath := filepath.Join(dir, injectManifestFile)
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "WARNING: %s has no injected files to clean up\n", dir)
+			return nil
+		}
+		return fmt.Errorf("problem reading %s: %v", manifestPath, err)
+	}
+	manifest := &injectManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return fmt.Errorf("problem parsing %s: %v", manifestPath, err)
+	}
+	for _, path := range append(append([]string{}, manifest.Files...), manifest.Directories...) {
+		if err := checkInjectPath(dir, path); err != nil {
+			return fmt.Errorf("%s lists %s: %v", manifestPath, path, err)
+		}
+	}
+	for _, file := range manifest.Files {
+		path := filepath.Join(dir, file)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("problem removing %s: %v", path, err)
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", file)
+	}
+	for i := len(manifest.Directories) - 1; i >= 0; i-- {
+		path := filepath.Join(dir, manifest.Directories[i])
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "WARNING: leaving %s in place: %v\n", path, err)
+		}
+	}
+	if err := os.Remove(manifestPath); err != nil {
+		return fmt.Errorf("problem removing %s: %v", manifestPath, err)
+	}
+	return nil
+}
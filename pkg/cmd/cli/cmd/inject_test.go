@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInjectFilesRefusesSymbolicLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inject")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, path := range []string{"link/secret", "link/nested/secret"} {
+		files := []injectedFile{{path: path, contents: []byte("secret"), mode: 0600}}
+		if err := injectFiles(dir, "myapp", files); err == nil {
+			t.Errorf("expected injecting %s through a symbolic link to fail", path)
+		}
+	}
+	if _, err := mkdirAllRecorded(dir, "link/nested"); err == nil {
+		t.Errorf("expected creating a directory through a symbolic link to fail")
+	}
+	entries, err := ioutil.ReadDir(outside)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("expected nothing to be written outside of the source, got %v, %v", entries, err)
+	}
+}
+
+func TestCleanupInjectedRefusesPathsOutsideOfTheSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inject")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempFile("", "outside")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	outside.Close()
+	defer os.Remove(outside.Name())
+	relative, err := filepath.Rel(dir, outside.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, manifest := range []string{
+		`{"files":["` + outside.Name() + `"]}`,
+		`{"files":["` + relative + `"]}`,
+		`{"directories":["sub/../.."]}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, injectManifestFile), []byte(manifest), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := cleanupInjected(dir); err == nil {
+			t.Errorf("expected cleaning up %s to fail", manifest)
+		}
+		if _, err := os.Stat(outside.Name()); err != nil {
+			t.Fatalf("expected %s to be left in place: %v", outside.Name(), err)
+		}
+	}
+}
+
+func TestInjectFilesAndCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inject")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []injectedFile{{path: "config/nested/settings", contents: []byte("value"), mode: 0644}}
+	if err := injectFiles(dir, "myapp", files); err != nil {
+		t.Fatalf("unexpected error injecting: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "config/nested/settings")); err != nil || string(data) != "value" {
+		t.Fatalf("expected the injected file, got %q, %v", data, err)
+	}
+	if err := cleanupInjected(dir); err != nil {
+		t.Fatalf("unexpected error cleaning up: %v", err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("expected the source to be left empty, got %v, %v", entries, err)
+	}
+}
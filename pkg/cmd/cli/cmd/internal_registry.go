@@ -3,8 +3,11 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/gabemontero/obu/pkg/api"
 	"github.com/gabemontero/obu/pkg/util"
@@ -12,48 +15,91 @@ import (
 	"github.com/spf13/cobra"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	kubeset "k8s.io/client-go/kubernetes"
 )
 
+const defaultImageRegistryHost = "image-registry.openshift-image-registry"
+
 func NewCmdInternalRegistry(cfg *api.Config) *cobra.Command {
 	regCmd := &cobra.Command{
-		Use:     "registry [<options>]",
-		Short:   "Access OpenShift internal registry configuration.",
-		Long:    "Pull various elements from OpenShift's internal registry configuration.",
+		Use:   "registry [<options>]",
+		Short: "Access OpenShift internal registry configuration.",
+		Long:  "Pull various elements from OpenShift's internal registry configuration.",
 		Example: `
 # Print ca.crt file content for accessing the OpenShift internal registry over HTTPS.  This will inspect
 # config maps in the openshift-controller-manager namespace.
 $ obu registry --ca-data
 
-# Print Docker config file content for authenticating with the OpenShift internal registry.
+# Write Docker config file content for authenticating with the OpenShift internal registry to a file only
+# readable by its owner.
+$ obu registry --docker-cfg-file --output-file config.json
+
+# Print it with the passwords and tokens masked, which is the default unless stdout is redirected to a file.
 $ obu registry --docker-cfg-file
+
+# Print Docker config file content in the form kaniko expects at /kaniko/.docker/config.json
+$ obu registry --docker-cfg-file --for kaniko
+
+# Write the credentials as jib system properties, and pass them to a Maven build
+$ obu registry --for jib --auth-properties --output-file jib-auth.properties
+$ mvn compile jib:build $(sed 's/^/-D/' jib-auth.properties)
+
+# Write the registry credentials, CA, and mirror configuration where buildah expects them
+$ obu registry --for buildah --install
+
+# Print Docker config file content using a short lived token for the pipeline service account, for clusters where
+# the image registry operator does not generate dockercfg secrets
+$ obu registry --docker-cfg-file --token-service-account pipeline --token-expiration 30m
 `,
 		Run: func(cmd *cobra.Command, args []string) {
-			kubeconfig, err := util.GetConfig(cfg)
+			clients, err := util.GetClients(cfg)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "ERROR: problem with kubeconfig: %v\n", err)
 				return
 			}
-			coreClient := util.GetCoreClient(kubeconfig)
-			registryCAMap, err := coreClient.CoreV1().ConfigMaps("openshift-image-registry").Get("serviceca", metav1.GetOptions{})
+			registryCAData, err := getImageRegistryCAData(clients)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "ERROR: problem retrieving registry CA config map: %v\n", err)
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
 				return
 			}
-			if registryCAMap == nil || len(registryCAMap.Data) == 0 {
-				fmt.Fprintf(os.Stderr, "ERROR: registry CA data is not available\n")
-				return
-			}
-			registryCAData, exists := registryCAMap.Data[buildv1.ServiceCAKey]
-			if !exists {
-				fmt.Fprintf(os.Stderr, "ERROR: registry CA data has not been set\n")
-				return
+			// credentials printed to a terminal or a pipe, i.e. the log of a Tekton step, are masked unless asked not to
+			if !cmd.Flags().Changed("redact") {
+				cfg.Redact = !util.IsRegularFile(os.Stdout)
 			}
 			switch {
 			case cfg.CADataOnly:
+				if len(cfg.OutputFile) > 0 {
+					outputFile := util.GetTektonOutputFile(cfg.OutputFile, util.TektonWorkspaceDir)
+					if err := ioutil.WriteFile(outputFile, []byte(registryCAData), 0644); err != nil {
+						fmt.Fprintf(os.Stderr, "ERROR: problem writing registry CA to %s: %v\n", outputFile, err)
+					}
+					return
+				}
 				fmt.Fprintf(os.Stdout, registryCAData)
+			case cfg.Install:
+				if len(cfg.BuildTool) == 0 {
+					fmt.Fprintf(os.Stderr, "ERROR: --install requires a build tool to be specified with --for\n")
+					return
+				}
+				err := installBuildToolConfig(cfg, clients, registryCAData)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: problem installing %s configuration: %v\n", cfg.BuildTool, err)
+				}
+			case cfg.AuthProperties:
+				if cfg.BuildTool != "jib" {
+					fmt.Fprintf(os.Stderr, "ERROR: --auth-properties is only supported with --for jib\n")
+					return
+				}
+				if err := dumpJibAuthProperties(cfg, clients); err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				}
 			case cfg.DockerConfigFile:
-				err := dumpBuilderDockerCfg(cfg, coreClient)
+				if len(cfg.BuildTool) > 0 {
+					if _, err := getBuildToolProfile(cfg.BuildTool); err != nil {
+						fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+						return
+					}
+				}
+				err := dumpBuilderDockerCfg(cfg, clients)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, err.Error())
 				}
@@ -66,50 +112,229 @@ $ obu registry --docker-cfg-file
 		"Only list the raw CA CRT data (ca.crt contents) for accessing the registry.")
 	regCmd.Flags().BoolVar(&(cfg.DockerConfigFile), "docker-cfg-file", cfg.DockerConfigFile,
 		"Only print the docker config file for pushing to/pulling from the image internal image registry)")
-	regCmd.Flags().StringVarP(&(cfg.Namespace), "namespace", "n", "",
-		"Specify the namespace whose OpenShift builder service account should be inspected for docker authentication config")
+	regCmd.Flags().StringVar(&(cfg.BuildTool), "for", cfg.BuildTool,
+		fmt.Sprintf("Tailor the output for a specific build tool (one of %s).  The docker config file is always converted to the 'auths' form with the 'auth' field populated.", strings.Join(buildToolNames(), ", ")))
+	regCmd.Flags().BoolVar(&(cfg.AuthProperties), "auth-properties", cfg.AuthProperties,
+		"With --for jib, print the credentials as the jib.to.auth and jib.from.auth properties instead of a docker config file.")
+	regCmd.Flags().BoolVar(&(cfg.Install), "install", cfg.Install,
+		"With --for, write the docker config file, registry CA, and any mirror registries.conf to the locations the build tool reads them from, merging into existing docker config and registries.conf files, and list the files written.")
+	defaultServiceAccount := "builder"
+	if util.IsTekton() {
+		defaultServiceAccount = util.TektonServiceAccount
+	}
+	regCmd.Flags().StringVar(&(cfg.ServiceAccount), "service-account", defaultServiceAccount,
+		"The service account whose secrets and image pull secrets are inspected for docker authentication config.  Defaults to 'pipeline' when running in a Tekton step.")
+	regCmd.Flags().StringVar(&(cfg.OutputFile), "output-file", cfg.OutputFile,
+		"Write the output to this file instead of stdout, readable by its owner only for the docker config file.  In a Tekton step, relative paths are under /workspace.")
+	regCmd.Flags().BoolVar(&(cfg.Redact), "redact", true,
+		"Mask the passwords and tokens of a printed docker config file.  Defaults to false when stdout is redirected to a file, and does not apply to --output-file.")
+	regCmd.Flags().StringVar(&(cfg.RegistryHost), "registry-host", cfg.RegistryHost,
+		"The host[:port] of the internal image registry.  Discovered from the cluster image config and image streams when not set.")
+	regCmd.Flags().StringVar(&(cfg.Secret), "secret", cfg.Secret,
+		"Use this docker secret from the namespace instead of searching the service account's secrets.")
+	regCmd.Flags().BoolVar(&(cfg.UseToken), "use-token", cfg.UseToken,
+		"Build the docker config file from the bearer token obu is running with rather than the service account's dockercfg secrets.")
+	regCmd.Flags().StringVar(&(cfg.TokenServiceAccount), "token-service-account", cfg.TokenServiceAccount,
+		"Build the docker config file from a token requested for this service account rather than its dockercfg secrets.")
+	regCmd.Flags().DurationVar(&(cfg.TokenExpiration), "token-expiration", time.Hour,
+		"How long a token requested with --token-service-account is valid for.")
 	return regCmd
 }
 
-// elements from build controller in OCM
-func dumpBuilderDockerCfg(cfg *api.Config, coreClient *kubeset.Clientset) error {
-	saName := "builder"
-	namespace := cfg.Namespace
-	if len(namespace) == 0 {
-		namespace = util.GetCurrentProject()
-		if len(namespace) == 0 {
-			return fmt.Errorf("ERROR: Need a namespace to fetch registry secrets")
-		}
+func dumpBuilderDockerCfg(cfg *api.Config, clients *util.Clients) error {
+	namespace, err := util.GetNamespace(cfg)
+	if err != nil {
+		return err
+	}
+	builderSecret, registryHosts, err := getRegistryAuthSecret(cfg, clients, namespace)
+	if err != nil {
+		return err
+	}
+	contents := ""
+	if len(cfg.BuildTool) == 0 {
+		contents, err = getDockerConfigFileStringForImageRegistryHost(builderSecret, registryHosts)
+	} else {
+		contents, err = getNormalizedDockerConfigFileString(builderSecret)
 	}
-	secrets := []corev1.Secret{}
-	sa, err := coreClient.CoreV1().ServiceAccounts(namespace).Get(saName, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
-	for _, ref := range sa.Secrets {
-		secret, err := coreClient.CoreV1().Secrets(namespace).Get(ref.Name, metav1.GetOptions{})
+	return printCredentials(cfg, contents)
+}
+
+func dumpJibAuthProperties(cfg *api.Config, clients *util.Clients) error {
+	namespace, err := util.GetNamespace(cfg)
+	if err != nil {
+		return err
+	}
+	builderSecret, registryHosts, err := getRegistryAuthSecret(cfg, clients, namespace)
+	if err != nil {
+		return err
+	}
+	if len(cfg.OutputFile) > 0 {
+		contents, err := getJibAuthPropertiesString(builderSecret, registryHosts, false)
 		if err != nil {
 			return err
 		}
+		return writeCredentialsFile(util.GetTektonOutputFile(cfg.OutputFile, util.TektonWorkspaceDir), contents)
+	}
+	contents, err := getJibAuthPropertiesString(builderSecret, registryHosts, cfg.Redact)
+	if err != nil {
+		return err
+	}
+	if cfg.Redact {
+		fmt.Fprintf(os.Stderr, "WARNING: credentials are redacted, write them with --output-file or print them with --redact=false\n")
+	} else if util.IsTerminal(os.Stdout) {
+		fmt.Fprintf(os.Stderr, "WARNING: printing credentials to a terminal, consider --output-file instead\n")
+	}
+	fmt.Fprintf(os.Stdout, "%s", contents)
+	return nil
+}
+
+// getImageRegistryCAData returns the service CA the internal image registry's serving certificate is signed by.
+func getImageRegistryCAData(clients *util.Clients) (string, error) {
+	registryCAMap, err := clients.Core.CoreV1().ConfigMaps("openshift-image-registry").Get("serviceca", metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("problem retrieving registry CA config map: %v", err)
+	}
+	if registryCAMap == nil || len(registryCAMap.Data) == 0 {
+		return "", fmt.Errorf("registry CA data is not available")
+	}
+	registryCAData, exists := registryCAMap.Data[buildv1.ServiceCAKey]
+	if !exists {
+		return "", fmt.Errorf("registry CA data has not been set")
+	}
+	return registryCAData, nil
+}
+
+// elements from build controller in OCM
+func getBuilderDockerCfgSecret(cfg *api.Config, clients *util.Clients, namespace string) (*corev1.Secret, []string, error) {
+	coreClient := clients.Core
+	saName := cfg.ServiceAccount
+	registryHosts := getImageRegistryHosts(cfg, clients, namespace)
+
+	secretNames := []string{}
+	if len(cfg.Secret) > 0 {
+		secretNames = append(secretNames, cfg.Secret)
+	} else {
+		sa, err := coreClient.CoreV1().ServiceAccounts(namespace).Get(saName, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, ref := range sa.Secrets {
+			secretNames = append(secretNames, ref.Name)
+		}
+		for _, ref := range sa.ImagePullSecrets {
+			secretNames = append(secretNames, ref.Name)
+		}
+	}
+
+	secrets := []corev1.Secret{}
+	seen := map[string]bool{}
+	for _, secretName := range secretNames {
+		if seen[secretName] {
+			continue
+		}
+		seen[secretName] = true
+		secret, err := coreClient.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+		if err != nil {
+			// an explicitly requested secret has to exist, but a service account commonly lists image pull
+			// secrets that were never created
+			if len(cfg.Secret) > 0 {
+				return nil, nil, err
+			}
+			fmt.Fprintf(os.Stderr, "WARNING: skipping secret %s of service account %s: %v\n", secretName, saName, err)
+			continue
+		}
 		secrets = append(secrets, *secret)
 	}
-	for _, builderSecret := range secrets {
+	for i, builderSecret := range secrets {
 		if builderSecret.Type == corev1.SecretTypeDockercfg || builderSecret.Type == corev1.SecretTypeDockerConfigJson {
-			contents, err := getDockerConfigFileStringForImageRegistryHost(&builderSecret)
+			auths, err := getDockerConfigAuths(&builderSecret)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
-			if len(contents) == 0 {
+			if !hasImageRegistryHost(auths, registryHosts) {
 				continue
 			}
-			fmt.Fprintf(os.Stdout, contents)
-			return nil
+			return &secrets[i], registryHosts, nil
+		}
+	}
+	if len(cfg.Secret) > 0 {
+		return nil, nil, fmt.Errorf("ERROR: Secret %s is not a docker secret for image registry hosts %s", cfg.Secret, strings.Join(registryHosts, ", "))
+	}
+	return nil, nil, fmt.Errorf("ERROR: No image registry docker secrets associated with build service account %s", saName)
+}
+
+// getImageRegistryHosts returns the host names the internal image registry is known by, either as explicitly
+// specified, or as discovered from the cluster's image config and the image streams in the namespace.
+func getImageRegistryHosts(cfg *api.Config, clients *util.Clients, namespace string) []string {
+	if len(cfg.RegistryHost) > 0 {
+		return []string{cfg.RegistryHost}
+	}
+	registryHosts := []string{}
+	imageConfig, err := clients.Config.ConfigV1().Images().Get("cluster", metav1.GetOptions{})
+	if err == nil {
+		if len(imageConfig.Status.InternalRegistryHostname) > 0 {
+			registryHosts = append(registryHosts, imageConfig.Status.InternalRegistryHostname)
+		}
+		registryHosts = append(registryHosts, imageConfig.Status.ExternalRegistryHostnames...)
+	}
+	streams, err := clients.Image.ImageV1().ImageStreams(namespace).List(metav1.ListOptions{})
+	if err == nil {
+		for _, is := range streams.Items {
+			repo := is.Status.DockerImageRepository
+			if len(repo) > 0 {
+				registryHosts = append(registryHosts, strings.SplitN(repo, "/", 2)[0])
+			}
 		}
 	}
-	return fmt.Errorf("ERROR: No image registry docker secrets associated with build service account %s", saName)
+	// fall back to the service host names the image registry operator has always used
+	registryHosts = append(registryHosts, defaultImageRegistryHost+".svc:5000", defaultImageRegistryHost+".svc.cluster.local:5000")
+
+	uniqueHosts := []string{}
+	seen := map[string]bool{}
+	for _, host := range registryHosts {
+		if !seen[host] {
+			seen[host] = true
+			uniqueHosts = append(uniqueHosts, host)
+		}
+	}
+	return uniqueHosts
 }
 
-func getDockerConfigFileStringForImageRegistryHost(secret *corev1.Secret) (string, error) {
+// getDockerConfigAuths returns the per registry credentials of either a legacy dockercfg or a dockerconfigjson secret.
+func getDockerConfigAuths(secret *corev1.Secret) (DockerConfig, error) {
+	key := ""
+	switch secret.Type {
+	case corev1.SecretTypeDockercfg:
+		key = corev1.DockerConfigKey
+	case corev1.SecretTypeDockerConfigJson:
+		key = corev1.DockerConfigJsonKey
+	default:
+		return nil, fmt.Errorf("ERROR: Secret %s is of type %s and not a docker config secret", secret.Name, secret.Type)
+	}
+	secretEncodedData, exists := secret.Data[key]
+	if !exists {
+		return nil, fmt.Errorf("ERROR: No data at key %s for secret %s", key, secret.Name)
+	}
+	var err error
+	auths := DockerConfig{}
+	switch secret.Type {
+	case corev1.SecretTypeDockercfg:
+		err = json.Unmarshal(secretEncodedData, &auths)
+	case corev1.SecretTypeDockerConfigJson:
+		dockercfgjson := DockerConfigJson{}
+		err = json.Unmarshal(secretEncodedData, &dockercfgjson)
+		auths = dockercfgjson.Auths
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: Problem decoding data at key %s for secret %s: %v", key, secret.Name, err)
+	}
+	return auths, nil
+}
+
+func getDockerConfigFileStringForImageRegistryHost(secret *corev1.Secret, registryHosts []string) (string, error) {
 	key := ""
 	switch secret.Type {
 	case corev1.SecretTypeDockercfg:
@@ -127,7 +352,7 @@ func getDockerConfigFileStringForImageRegistryHost(secret *corev1.Secret) (strin
 	case corev1.SecretTypeDockercfg:
 		dockercfg := DockerConfig{}
 		err = json.Unmarshal(secretEncodedData, &dockercfg)
-		found := hasImageRegistryHost(dockercfg)
+		found := hasImageRegistryHost(dockercfg, registryHosts)
 		if !found {
 			return "", nil
 		}
@@ -135,7 +360,7 @@ func getDockerConfigFileStringForImageRegistryHost(secret *corev1.Secret) (strin
 	case corev1.SecretTypeDockerConfigJson:
 		dockercfgjson := DockerConfigJson{}
 		err = json.Unmarshal(secretEncodedData, &dockercfgjson)
-		found := hasImageRegistryHost(dockercfgjson.Auths)
+		found := hasImageRegistryHost(dockercfgjson.Auths, registryHosts)
 		if !found {
 			return "", nil
 		}
@@ -147,9 +372,27 @@ func getDockerConfigFileStringForImageRegistryHost(secret *corev1.Secret) (strin
 	return string(secretDecodedData), nil
 }
 
-func hasImageRegistryHost(auths DockerConfig) bool {
+func hasImageRegistryHost(auths DockerConfig, registryHosts []string) bool {
 	for hostPort := range auths {
-		if strings.HasPrefix(hostPort, "image-registry.openshift-image-registry") {
+		if isImageRegistryHost(hostPort, registryHosts) {
+			return true
+		}
+	}
+	return false
+}
+
+// isImageRegistryHost matches the host[:port] of a docker config entry against the registry hosts exactly, so that
+// credentials are never handed to a look-alike host.  Registry hosts without a port match any port of that host.
+func isImageRegistryHost(hostPort string, registryHosts []string) bool {
+	host := hostPort
+	if h, _, err := net.SplitHostPort(hostPort); err == nil {
+		host = h
+	}
+	for _, registryHost := range registryHosts {
+		if hostPort == registryHost {
+			return true
+		}
+		if _, _, err := net.SplitHostPort(registryHost); err != nil && host == registryHost {
 			return true
 		}
 	}
@@ -192,6 +435,7 @@ type DockerConfig map[string]DockerConfigEntry
 type DockerConfigEntry struct {
 	Username string               `json:"username"`
 	Password string               `json:"password"`
+	Auth     string               `json:"auth,omitempty"`
 	Email    string               `json:"email"`
 	Provider DockerConfigProvider `json:"provider,omitempty"`
 }
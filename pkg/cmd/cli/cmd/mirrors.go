@@ -3,9 +3,11 @@ package cmd
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
 
-	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 
@@ -13,21 +15,23 @@ import (
 	"github.com/gabemontero/obu/pkg/api"
 	"github.com/gabemontero/obu/pkg/util"
 
+	dockerreference "github.com/containers/image/docker/reference"
 	"github.com/containers/image/pkg/sysregistriesv2"
+	"github.com/containers/image/types"
+	"github.com/openshift/library-go/pkg/image/reference"
 	rutils "github.com/openshift/runtime-utils/pkg/registries"
 
-	operatorv1alpha1 "github.com/openshift/api/operator/v1alpha1"
 	configv1 "github.com/openshift/api/config/v1"
+	operatorv1alpha1 "github.com/openshift/api/operator/v1alpha1"
 
 	"github.com/spf13/cobra"
-
 )
 
 func NewCmdMirrorRegistryConf(cfg *api.Config) *cobra.Command {
 	regCmd := &cobra.Command{
-		Use:     "mirror [<options>]",
-		Short:   "Access OpenShift mirrors registry configuration.",
-		Long:    "Pull various elements from OpenShift's mirrors registry configuration.",
+		Use:   "mirror [<options>]",
+		Short: "Access OpenShift mirrors registry configuration.",
+		Long:  "Pull various elements from OpenShift's mirrors registry configuration.",
 		Example: `
 # Print ca.crt file content for accessing the OpenShift mirror registry over HTTPS.  This will inspect
 # config maps in the openshift-config namespace.
@@ -37,39 +41,28 @@ $ obu mirror --ca-data
 $ obu mirror --docker-cfg-file
 `,
 		Run: func(cmd *cobra.Command, args []string) {
-			kubeconfig, err := util.GetConfig(cfg)
+			clients, err := util.GetClients(cfg)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "ERROR: problem with kubeconfig: %v\n", err)
 				return
 			}
-			imageConfigClient := util.GetImageConfigClient(kubeconfig)
+			imageConfigClient := clients.Config.ConfigV1().Images()
 			imageConfig, err := imageConfigClient.Get("cluster", metav1.GetOptions{})
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "ERROR: problem getting global image config: %v\n", err)
 				return
 			}
-			coreClient := util.GetCoreClient(kubeconfig)
-			mirrorCA, err := coreClient.CoreV1().ConfigMaps("openshift-config").Get(
-				imageConfig.Spec.AdditionalTrustedCA.Name, metav1.GetOptions{})
-			if err != nil && errors.IsNotFound(err) {
-				fmt.Fprintf(os.Stderr, "ERROR: problem getting mirror registry CAs: %v\n", err)
+			mirrorCAData, err := getMirrorRegistryCAData(clients, imageConfig)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
 				return
 			}
-			mirrorClient := util.GetImageMirrorClient(kubeconfig)
-			imageContentSourcePolicies, err := mirrorClient.List(
-				metav1.ListOptions{LabelSelector: labels.Everything().String()})
 
 			switch {
 			case cfg.CADataOnly:
-				for _, ca := range mirrorCA.Data {
-					fmt.Fprintf(os.Stdout, ca)
-				}
+				fmt.Fprintf(os.Stdout, mirrorCAData)
 			case cfg.DockerConfigFile:
-				polices := []*operatorv1alpha1.ImageContentSourcePolicy{}
-				for _, policy := range imageContentSourcePolicies.Items {
-					polices = append(polices, &policy)
-				}
-				content, err := createBuildRegistriesConfigData(imageConfig, polices)
+				content, err := getBuildRegistriesConfigData(clients, imageConfig)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "ERROR: problem building registry config: %v\n", err)
 					return
@@ -87,6 +80,97 @@ $ obu mirror --docker-cfg-file
 	return regCmd
 }
 
+// getMirrorRegistryCAData returns the additional CAs the cluster trusts for registries, in the order of the
+// registry host names they are keyed by in the config map the image config refers to.
+func getMirrorRegistryCAData(clients *util.Clients, imageConfig *configv1.Image) (string, error) {
+	if len(imageConfig.Spec.AdditionalTrustedCA.Name) == 0 {
+		return "", nil
+	}
+	mirrorCA, err := clients.Core.CoreV1().ConfigMaps("openshift-config").Get(
+		imageConfig.Spec.AdditionalTrustedCA.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("problem getting mirror registry CAs: %v", err)
+	}
+	hosts := []string{}
+	for host := range mirrorCA.Data {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	caData := ""
+	for _, host := range hosts {
+		caData += mirrorCA.Data[host]
+	}
+	return caData, nil
+}
+
+// getBuildRegistriesConfigData pulls the cluster's image content source policies and combines them with the global
+// image config to produce the registries.conf content for a build.
+func getBuildRegistriesConfigData(clients *util.Clients, imageConfig *configv1.Image) (string, error) {
+	polices, err := getImageContentSourcePolicies(clients)
+	if err != nil {
+		return "", err
+	}
+	return createBuildRegistriesConfigData(imageConfig, polices)
+}
+
+// getImagePullSources returns the locations to pull an image from, in the order containers/image based tools try
+// them, as configured by the registries.conf given with --registries-conf, or else the one obu generates from the
+// cluster's image config and image content source policies.  Pulling from a blocked registry is an error.
+func getImagePullSources(cfg *api.Config, clients *util.Clients, imageConfig *configv1.Image, image string) ([]sysregistriesv2.PullSource, error) {
+	named, err := dockerreference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, err
+	}
+	sources := []sysregistriesv2.PullSource{{Endpoint: sysregistriesv2.Endpoint{Location: dockerreference.Domain(named)}, Reference: named}}
+	registriesConfPath := cfg.RegistriesConf
+	if len(registriesConfPath) == 0 {
+		registriesConf, err := getBuildRegistriesConfigData(clients, imageConfig)
+		if err != nil {
+			return nil, fmt.Errorf("problem building registry config: %v", err)
+		}
+		if len(registriesConf) == 0 {
+			return sources, nil
+		}
+		// the registries config can only be read from a file
+		file, err := ioutil.TempFile("", "registries.conf")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(file.Name())
+		_, err = file.WriteString(registriesConf)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		registriesConfPath = file.Name()
+	}
+	registry, err := sysregistriesv2.FindRegistry(&types.SystemContext{SystemRegistriesConfPath: registriesConfPath}, named.Name())
+	if err != nil {
+		return nil, fmt.Errorf("problem reading registry config %s: %v", registriesConfPath, err)
+	}
+	if registry == nil {
+		return sources, nil
+	}
+	if registry.Blocked {
+		return nil, fmt.Errorf("pulling %s from registry %s is blocked", image, registry.Location)
+	}
+	return registry.PullSourcesFromReference(named)
+}
+
+func getImageContentSourcePolicies(clients *util.Clients) ([]*operatorv1alpha1.ImageContentSourcePolicy, error) {
+	mirrorClient := clients.Operator.OperatorV1alpha1().ImageContentSourcePolicies()
+	imageContentSourcePolicies, err := mirrorClient.List(
+		metav1.ListOptions{LabelSelector: labels.Everything().String()})
+	if err != nil {
+		return nil, err
+	}
+	polices := []*operatorv1alpha1.ImageContentSourcePolicy{}
+	for i := range imageContentSourcePolicies.Items {
+		polices = append(polices, &imageContentSourcePolicies.Items[i])
+	}
+	return polices, nil
+}
+
 func createBuildRegistriesConfigData(config *configv1.Image, policies []*operatorv1alpha1.ImageContentSourcePolicy) (string, error) {
 
 	blockedRegs := []string{}
@@ -118,4 +202,102 @@ func createBuildRegistriesConfigData(config *configv1.Image, policies []*operato
 		return "", nil
 	}
 	return string(newData.Bytes()), nil
-}
\ No newline at end of file
+}
+
+// mergeBuildRegistriesConfigData applies the global image config and image content source policies to an existing
+// registries.conf, keeping its search registries, its registry entries and any settings obu does not know about.
+// Files in the sysregistries v1 format are converted, as the two formats cannot be mixed.
+func mergeBuildRegistriesConfigData(existing string, config *configv1.Image, policies []*operatorv1alpha1.ImageContentSourcePolicy) (string, error) {
+	raw := map[string]interface{}{}
+	if _, err := toml.Decode(existing, &raw); err != nil {
+		return "", fmt.Errorf("problem parsing the existing registries.conf: %v", err)
+	}
+	parsed := struct {
+		sysregistriesv2.V2RegistriesConf
+		sysregistriesv2.V1RegistriesConf
+	}{}
+	if _, err := toml.Decode(existing, &parsed); err != nil {
+		return "", fmt.Errorf("problem parsing the existing registries.conf: %v", err)
+	}
+
+	configObj := parsed.V2RegistriesConf
+	configObj.UnqualifiedSearchRegistries = append(configObj.UnqualifiedSearchRegistries, parsed.V1TOMLConfig.Search.Registries...)
+	if len(configObj.UnqualifiedSearchRegistries) == 0 {
+		configObj.UnqualifiedSearchRegistries = []string{"docker.io"}
+	}
+	insecureRegs := append([]string{}, parsed.V1TOMLConfig.Insecure.Registries...)
+	blockedRegs := append([]string{}, parsed.V1TOMLConfig.Block.Registries...)
+	if config != nil {
+		insecureRegs = append(insecureRegs, config.Spec.RegistrySources.InsecureRegistries...)
+		blockedRegs = append(blockedRegs, config.Spec.RegistrySources.BlockedRegistries...)
+	}
+	if err := rutils.EditRegistriesConfig(&configObj, insecureRegs, blockedRegs, policies); err != nil {
+		return "", err
+	}
+
+	// round trip the edited settings through toml so that they can be laid over the existing ones
+	var editedData bytes.Buffer
+	if err := toml.NewEncoder(&editedData).Encode(configObj); err != nil {
+		return "", err
+	}
+	edited := map[string]interface{}{}
+	if _, err := toml.Decode(editedData.String(), &edited); err != nil {
+		return "", err
+	}
+	delete(raw, "registries")
+	for _, key := range []string{"registry", "unqualified-search-registries"} {
+		if value, ok := edited[key]; ok {
+			raw[key] = value
+		}
+	}
+	var newData bytes.Buffer
+	if err := toml.NewEncoder(&newData).Encode(raw); err != nil {
+		return "", err
+	}
+	return newData.String(), nil
+}
+
+// getImageMirrors applies the image content source policies to an image reference in the same fashion the
+// registries.conf generated from them would, returning the ordered list of pull specs to try: any mirrors for the
+// most specific matching source repository, followed by the original reference.  As with the policies themselves,
+// only references by digest are mirrored.
+func getImageMirrors(ref string, policies []operatorv1alpha1.ImageContentSourcePolicy) ([]string, error) {
+	parsed, err := reference.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	if len(parsed.ID) == 0 {
+		return []string{ref}, nil
+	}
+	repo := parsed.AsRepository().Exact()
+
+	source := ""
+	mirrors := []string{}
+	for _, policy := range policies {
+		for _, rdm := range policy.Spec.RepositoryDigestMirrors {
+			if repo != rdm.Source && !strings.HasPrefix(repo, rdm.Source+"/") {
+				continue
+			}
+			if len(rdm.Source) < len(source) {
+				continue
+			}
+			if len(rdm.Source) > len(source) {
+				source = rdm.Source
+				mirrors = []string{}
+			}
+			mirrors = append(mirrors, rdm.Mirrors...)
+		}
+	}
+
+	pullSpecs := []string{}
+	seen := map[string]bool{}
+	for _, mirror := range mirrors {
+		pullSpec := mirror + strings.TrimPrefix(repo, source) + "@" + parsed.ID
+		if seen[pullSpec] {
+			continue
+		}
+		seen[pullSpec] = true
+		pullSpecs = append(pullSpecs, pullSpec)
+	}
+	return append(pullSpecs, ref), nil
+}
@@ -0,0 +1,317 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+	"github.com/openshift/api/image/docker10"
+	imagev1 "github.com/openshift/api/image/v1"
+	"github.com/openshift/library-go/pkg/image/imageutil"
+	"github.com/openshift/library-go/pkg/image/reference"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// the same annotations OpenShift builds set on the images they produce
+	buildSourceLocationAnnotation = "openshift.io/build.source-location"
+	buildCommitIDAnnotation       = "openshift.io/build.commit.id"
+
+	buildPipelineRunAnnotation = "obu.gabemontero.github.io/build.pipelinerun"
+	buildBaseImagesAnnotation  = "obu.gabemontero.github.io/build.base-images"
+	buildProxyAnnotation       = "obu.gabemontero.github.io/build.proxy"
+	buildMirrorsAnnotation     = "obu.gabemontero.github.io/build.mirrors"
+
+	inTotoStatementType     = "https://in-toto.io/Statement/v0.1"
+	slsaProvenancePredicate = "https://slsa.dev/provenance/v0.2"
+	obuBuildType            = "https://github.com/gabemontero/obu/annotate-provenance@v1"
+)
+
+func NewCmdAnnotateProvenance(cfg *api.Config) *cobra.Command {
+	provenanceCmd := &cobra.Command{
+		Use:   "annotate-provenance <output imagestreamtag> [<options>]",
+		Short: "Record build provenance on the output image stream tag.",
+		Long: "Record the base images, source, pipeline run, and proxy and mirror configuration of a build as annotations on\n" +
+			"the output image stream tag, and emit the same information as an in-toto SLSA provenance statement.",
+		Example: `
+# Record the provenance of a build of myapp:latest from the nodejs:12 image stream tag in the openshift namespace
+$ obu annotate-provenance myapp:latest --base-image openshift/nodejs:12 \
+    --git-url https://github.com/myorg/myapp --git-commit 3f2bd5a --pipeline-run myapp-build-x7k2p
+
+# Same as above, writing the provenance statement to a file rather than stdout
+$ obu annotate-provenance myapp:latest --base-image quay.io/myorg/base:1.0 --output-file /workspace/provenance.json
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) == 0 {
+				fmt.Fprintf(os.Stderr, "ERROR: not enough arguments: %s\n", cmd.Use)
+				return
+			}
+			stream, tag, ok := imageutil.SplitImageStreamTag(args[0])
+			if !ok {
+				fmt.Fprintf(os.Stderr, "ERROR: invalid image stream tag reference (use '<stream>:<tag>'): %s\n", args[0])
+				return
+			}
+			clients, err := util.GetClients(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem with kubeconfig: %v\n", err)
+				return
+			}
+			namespace, err := util.GetNamespace(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+
+			statement, annotations, err := getBuildProvenance(cfg, clients, namespace, stream, tag)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			istClient := clients.Image.ImageV1().ImageStreamTags(namespace)
+			ist, err := istClient.Get(args[0], metav1.GetOptions{})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem retrieving image stream tag %s: %v\n", args[0], err)
+				return
+			}
+			if ist.Annotations == nil {
+				ist.Annotations = map[string]string{}
+			}
+			for key, value := range annotations {
+				ist.Annotations[key] = value
+			}
+			if _, err := istClient.Update(ist); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem annotating image stream tag %s: %v\n", args[0], err)
+				return
+			}
+
+			data, err := json.MarshalIndent(statement, "", "  ")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem encoding provenance: %v\n", err)
+				return
+			}
+			cfg.OutputFile = util.GetTektonOutputFile(cfg.OutputFile, util.TektonWorkspaceDir)
+			if len(cfg.OutputFile) > 0 {
+				if err := ioutil.WriteFile(cfg.OutputFile, data, 0644); err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: problem writing provenance to %s: %v\n", cfg.OutputFile, err)
+				}
+				return
+			}
+			fmt.Fprintf(os.Stdout, "%s\n", data)
+		},
+	}
+	provenanceCmd.Flags().StringSliceVar(&(cfg.BaseImages), "base-image", cfg.BaseImages,
+		"An image the build was based on, as a [<namespace>/]<stream>:<tag>, [<namespace>/]<stream>@<id> or fully qualified docker image reference.  Can be repeated.")
+	provenanceCmd.Flags().StringVar(&(cfg.GitURL), "git-url", cfg.GitURL,
+		"The git repository the build's source came from.")
+	provenanceCmd.Flags().StringVar(&(cfg.GitCommit), "git-commit", cfg.GitCommit,
+		"The git commit the build's source was at.")
+	provenanceCmd.Flags().StringVar(&(cfg.PipelineRun), "pipeline-run", cfg.PipelineRun,
+		"The name of the Tekton PipelineRun that performed the build.")
+	provenanceCmd.Flags().StringVar(&(cfg.BuildFinishedOn), "build-finished-on", cfg.BuildFinishedOn,
+		"When the build completed, as an RFC 3339 timestamp.  Defaults to the creation time of the output image.")
+	provenanceCmd.Flags().StringVar(&(cfg.BuilderID), "builder-id", "https://tekton.dev/pipelines",
+		"The SLSA builder id recorded in the provenance statement.")
+	provenanceCmd.Flags().StringVar(&(cfg.OutputFile), "output-file", cfg.OutputFile,
+		"Write the provenance statement to this file instead of stdout.  In a Tekton step, relative paths are under /workspace.")
+	return provenanceCmd
+}
+
+// in-toto statement and SLSA v0.2 provenance predicate, only including the fields obu fills in
+
+type inTotoStatement struct {
+	Type          string            `json:"_type"`
+	Subject       []inTotoSubject   `json:"subject"`
+	PredicateType string            `json:"predicateType"`
+	Predicate     slsaProvenanceV02 `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type slsaProvenanceV02 struct {
+	Builder    slsaBuilder    `json:"builder"`
+	BuildType  string         `json:"buildType"`
+	Invocation slsaInvocation `json:"invocation"`
+	Metadata   slsaMetadata   `json:"metadata"`
+	Materials  []slsaMaterial `json:"materials,omitempty"`
+}
+
+type slsaBuilder struct {
+	ID string `json:"id"`
+}
+
+type slsaInvocation struct {
+	ConfigSource *slsaMaterial     `json:"configSource,omitempty"`
+	Parameters   map[string]string `json:"parameters,omitempty"`
+	Environment  map[string]string `json:"environment,omitempty"`
+}
+
+type slsaMetadata struct {
+	BuildInvocationID string `json:"buildInvocationId,omitempty"`
+	BuildFinishedOn   string `json:"buildFinishedOn,omitempty"`
+}
+
+type slsaMaterial struct {
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// getBuildProvenance resolves the base images and gathers the cluster configuration that applied to the build,
+// returning both the provenance statement for the output image and the annotations to record on its tag.
+func getBuildProvenance(cfg *api.Config, clients *util.Clients, namespace, stream, tag string) (*inTotoStatement, map[string]string, error) {
+	istName := imageutil.JoinImageStreamTag(stream, tag)
+	ist, err := clients.Image.ImageV1().ImageStreamTags(namespace).Get(istName, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("problem retrieving image stream tag %s: %v", istName, err)
+	}
+	subject, err := newDigestMaterial(ist.Image.DockerImageReference)
+	if err != nil {
+		return nil, nil, fmt.Errorf("output image stream tag %s has no image digest: %v", istName, err)
+	}
+	finishedOn, err := getBuildFinishedOn(cfg, &ist.Image)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	statement := &inTotoStatement{
+		Type:          inTotoStatementType,
+		Subject:       []inTotoSubject{{Name: subject.URI, Digest: subject.Digest}},
+		PredicateType: slsaProvenancePredicate,
+		Predicate: slsaProvenanceV02{
+			Builder:   slsaBuilder{ID: cfg.BuilderID},
+			BuildType: obuBuildType,
+			Invocation: slsaInvocation{
+				Parameters:  map[string]string{},
+				Environment: map[string]string{"namespace": namespace},
+			},
+			Metadata: slsaMetadata{
+				BuildInvocationID: cfg.PipelineRun,
+				BuildFinishedOn:   finishedOn,
+			},
+		},
+	}
+	annotations := map[string]string{}
+
+	if len(cfg.GitURL) > 0 {
+		source := slsaMaterial{URI: "git+" + cfg.GitURL}
+		if len(cfg.GitCommit) > 0 {
+			source.Digest = map[string]string{"sha1": cfg.GitCommit}
+			annotations[buildCommitIDAnnotation] = cfg.GitCommit
+		}
+		statement.Predicate.Invocation.ConfigSource = &source
+		statement.Predicate.Materials = append(statement.Predicate.Materials, source)
+		annotations[buildSourceLocationAnnotation] = cfg.GitURL
+	}
+	if len(cfg.PipelineRun) > 0 {
+		statement.Predicate.Invocation.Environment["pipelineRun"] = cfg.PipelineRun
+		annotations[buildPipelineRunAnnotation] = cfg.PipelineRun
+	}
+
+	baseImages := []string{}
+	for _, baseImage := range cfg.BaseImages {
+		ref, err := parseNamespacedImageReference(baseImage, namespace)
+		if err != nil {
+			return nil, nil, err
+		}
+		// provenance is only meaningful for the exact images used, so always pin to digests
+		translateCfg := *cfg
+		translateCfg.SHA = true
+		translateCfg.ResolveDigest = true
+		img, err := translateObjectReference(&translateCfg, clients, ref)
+		if err != nil {
+			return nil, nil, fmt.Errorf("problem resolving base image %s: %v", baseImage, err)
+		}
+		material, err := newDigestMaterial(img)
+		if err != nil {
+			return nil, nil, fmt.Errorf("base image %s did not resolve to a digest: %v", baseImage, err)
+		}
+		statement.Predicate.Materials = append(statement.Predicate.Materials, material)
+		baseImages = append(baseImages, img)
+	}
+	if len(baseImages) > 0 {
+		annotations[buildBaseImagesAnnotation] = strings.Join(baseImages, ",")
+	}
+
+	proxy, err := clients.Config.ConfigV1().Proxies().Get("cluster", metav1.GetOptions{})
+	if err == nil {
+		proxyParams := map[string]string{
+			"HTTP_PROXY":  proxy.Status.HTTPProxy,
+			"HTTPS_PROXY": proxy.Status.HTTPSProxy,
+			"NO_PROXY":    proxy.Status.NoProxy,
+		}
+		settings := []string{}
+		for _, key := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"} {
+			if len(proxyParams[key]) > 0 {
+				statement.Predicate.Invocation.Parameters[key] = proxyParams[key]
+				settings = append(settings, key+"="+proxyParams[key])
+			}
+		}
+		if len(settings) > 0 {
+			annotations[buildProxyAnnotation] = strings.Join(settings, ";")
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "WARNING: not recording proxy configuration: %v\n", err)
+	}
+
+	policies, err := clients.Operator.OperatorV1alpha1().ImageContentSourcePolicies().List(metav1.ListOptions{})
+	if err == nil {
+		mirrors := []string{}
+		for _, policy := range policies.Items {
+			for _, rdm := range policy.Spec.RepositoryDigestMirrors {
+				mirrors = append(mirrors, rdm.Source+"="+strings.Join(rdm.Mirrors, ","))
+			}
+		}
+		if len(mirrors) > 0 {
+			statement.Predicate.Invocation.Parameters["mirrors"] = strings.Join(mirrors, ";")
+			annotations[buildMirrorsAnnotation] = strings.Join(mirrors, ";")
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "WARNING: not recording mirror configuration: %v\n", err)
+	}
+
+	return statement, annotations, nil
+}
+
+// getBuildFinishedOn returns the completion time of the build, which unless given is when the build committed the
+// output image.  Nothing is returned when neither is known, rather than a time unrelated to the build.
+func getBuildFinishedOn(cfg *api.Config, image *imagev1.Image) (string, error) {
+	if len(cfg.BuildFinishedOn) > 0 {
+		finishedOn, err := time.Parse(time.RFC3339, cfg.BuildFinishedOn)
+		if err != nil {
+			return "", fmt.Errorf("invalid --build-finished-on timestamp %q: %v", cfg.BuildFinishedOn, err)
+		}
+		return finishedOn.UTC().Format(time.RFC3339), nil
+	}
+	if err := imageutil.ImageWithMetadata(image); err != nil {
+		return "", fmt.Errorf("problem reading the metadata of output image %s: %v", image.Name, err)
+	}
+	if metadata, ok := image.DockerImageMetadata.Object.(*docker10.DockerImage); ok && !metadata.Created.IsZero() {
+		return metadata.Created.UTC().Format(time.RFC3339), nil
+	}
+	fmt.Fprintf(os.Stderr, "WARNING: the creation time of output image %s is unknown, specify when the build finished with --build-finished-on\n", image.Name)
+	return "", nil
+}
+
+// newDigestMaterial splits an image reference by digest into its repository and digest
+func newDigestMaterial(img string) (slsaMaterial, error) {
+	parsed, err := reference.Parse(img)
+	if err != nil {
+		return slsaMaterial{}, err
+	}
+	algorithmDigest := strings.SplitN(parsed.ID, ":", 2)
+	if len(algorithmDigest) != 2 {
+		return slsaMaterial{}, fmt.Errorf("%s is not a reference by digest", img)
+	}
+	return slsaMaterial{
+		URI:    parsed.AsRepository().Exact(),
+		Digest: map[string]string{algorithmDigest[0]: algorithmDigest[1]},
+	}, nil
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+)
+
+const redactedValue = "REDACTED"
+
+// redactedKeys are the docker config file fields that hold secrets, in either the dockercfg or the config.json form
+var redactedKeys = map[string]bool{
+	"auth":          true,
+	"password":      true,
+	"identitytoken": true,
+	"registrytoken": true,
+}
+
+// printCredentials writes credentials to the output file, readable by its owner only, or otherwise prints them,
+// with their secrets masked when redacting.
+func printCredentials(cfg *api.Config, contents string) error {
+	if len(cfg.OutputFile) > 0 {
+		return writeCredentialsFile(util.GetTektonOutputFile(cfg.OutputFile, util.TektonWorkspaceDir), contents)
+	}
+	if len(contents) == 0 {
+		return nil
+	}
+	if cfg.Redact {
+		redacted, err := redactCredentials(contents)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "WARNING: credentials are redacted, write them with --output-file or print them with --redact=false\n")
+		contents = redacted
+	} else if util.IsTerminal(os.Stdout) {
+		fmt.Fprintf(os.Stderr, "WARNING: printing credentials to a terminal, consider --output-file instead\n")
+	}
+	fmt.Fprintf(os.Stdout, "%s", contents)
+	return nil
+}
+
+func writeCredentialsFile(path, contents string) error {
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		return fmt.Errorf("problem writing credentials to %s: %v", path, err)
+	}
+	// the permissions of a file that already existed are not changed by writing it
+	if err := os.Chmod(path, 0600); err != nil {
+		return fmt.Errorf("problem restricting permissions of %s: %v", path, err)
+	}
+	return nil
+}
+
+// redactCredentials masks the secret fields of a docker config file, keeping its structure and the registries and
+// user names it has credentials for.
+func redactCredentials(contents string) (string, error) {
+	var config interface{}
+	if err := json.Unmarshal([]byte(contents), &config); err != nil {
+		return "", fmt.Errorf("problem parsing credentials to redact: %v", err)
+	}
+	data, err := json.MarshalIndent(redactJSON(config), "", "\t")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func redactJSON(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, field := range typed {
+			if _, isString := field.(string); isString && redactedKeys[strings.ToLower(key)] && field != "" {
+				typed[key] = redactedValue
+				continue
+			}
+			typed[key] = redactJSON(field)
+		}
+	case []interface{}:
+		for i := range typed {
+			typed[i] = redactJSON(typed[i])
+		}
+	}
+	return value
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// the internal registry accepts any user name along with a valid bearer token for the password
+const tokenAuthUsername = "serviceaccount"
+
+// getRegistryAuthSecret returns the docker secret to use for the internal registry.  Unless a token has been
+// requested, that is the dockercfg secret the image registry operator generates for the service account; otherwise
+// an equivalent secret is synthesized in memory from a bearer token.
+func getRegistryAuthSecret(cfg *api.Config, clients *util.Clients, namespace string) (*corev1.Secret, []string, error) {
+	if !cfg.UseToken && len(cfg.TokenServiceAccount) == 0 {
+		return getBuilderDockerCfgSecret(cfg, clients, namespace)
+	}
+	registryHosts := getImageRegistryHosts(cfg, clients, namespace)
+
+	token := ""
+	var err error
+	if len(cfg.TokenServiceAccount) > 0 {
+		token, err = requestServiceAccountToken(cfg, clients, namespace)
+	} else {
+		token, err = getCurrentBearerToken(clients)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	auths := DockerConfig{}
+	for _, registryHost := range registryHosts {
+		auths[registryHost] = DockerConfigEntry{Username: tokenAuthUsername, Password: token}
+	}
+	data, err := json.Marshal(DockerConfigJson{Auths: auths})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "obu-token-auth", Namespace: namespace},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: data},
+	}, registryHosts, nil
+}
+
+// getCurrentBearerToken returns the token obu itself is using, whether that comes from the kubeconfig or from the
+// service account token mounted into the pod.
+func getCurrentBearerToken(clients *util.Clients) (string, error) {
+	if clients.RestConfig == nil {
+		return "", fmt.Errorf("ERROR: No bearer token is available when running offline")
+	}
+	if len(clients.RestConfig.BearerToken) > 0 {
+		return clients.RestConfig.BearerToken, nil
+	}
+	if len(clients.RestConfig.BearerTokenFile) > 0 {
+		data, err := ioutil.ReadFile(clients.RestConfig.BearerTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("ERROR: Problem reading bearer token file %s: %v", clients.RestConfig.BearerTokenFile, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", fmt.Errorf("ERROR: The current kubeconfig does not authenticate with a bearer token, use --token-service-account instead")
+}
+
+// requestServiceAccountToken obtains a bound token for the service account via the TokenRequest API.
+func requestServiceAccountToken(cfg *api.Config, clients *util.Clients, namespace string) (string, error) {
+	tokenRequest := &authenticationv1.TokenRequest{}
+	if cfg.TokenExpiration > 0 {
+		expirationSeconds := int64(cfg.TokenExpiration.Seconds())
+		tokenRequest.Spec.ExpirationSeconds = &expirationSeconds
+	}
+	tokenRequest, err := clients.Core.CoreV1().ServiceAccounts(namespace).CreateToken(cfg.TokenServiceAccount, tokenRequest)
+	if err != nil {
+		return "", fmt.Errorf("ERROR: Problem requesting a token for service account %s: %v", cfg.TokenServiceAccount, err)
+	}
+	if len(tokenRequest.Status.Token) == 0 {
+		return "", fmt.Errorf("ERROR: No token was issued for service account %s", cfg.TokenServiceAccount)
+	}
+	return tokenRequest.Status.Token, nil
+}
@@ -0,0 +1,338 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	dockerreference "github.com/containers/image/docker/reference"
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// the labels s2i reads from builder images, see https://github.com/openshift/source-to-image
+	s2iScriptsURLLabel       = "io.openshift.s2i.scripts-url"
+	s2iLegacyScriptsURLLabel = "io.s2i.scripts-url"
+	s2iDestinationLabel      = "io.openshift.s2i.destination"
+	s2iAssembleUserLabel     = "io.openshift.s2i.assemble-user"
+	s2iBuildImageLabel       = "io.openshift.build.image"
+
+	s2iDefaultDestination = "/tmp"
+	// s2iSourceScriptsDir holds scripts in the source repository that take precedence over those of the builder
+	s2iSourceScriptsDir = ".s2i/bin"
+	// s2iSourceEnvironmentFile holds environment variables for the build in the source repository
+	s2iSourceEnvironmentFile = ".s2i/environment"
+)
+
+// s2iScripts are the scripts s2i runs, in the order it runs them
+var s2iScripts = []string{"assemble", "run"}
+
+// dockerHubHosts are the registry hosts docker hub credentials can be stored under, docker itself using
+// https://index.docker.io/v1/
+var dockerHubHosts = map[string]bool{"docker.io": true, "index.docker.io": true, "registry-1.docker.io": true}
+
+func NewCmdS2I(cfg *api.Config) *cobra.Command {
+	s2iCmd := &cobra.Command{
+		Use:   "s2i",
+		Short: "Build source-to-image applications with any build tool.",
+		Long:  "Turn OpenShift Source strategy builds into builds a plain Dockerfile build tool like buildah can run.",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+	s2iCmd.AddCommand(NewCmdS2IGenerate(cfg))
+	return s2iCmd
+}
+
+func NewCmdS2IGenerate(cfg *api.Config) *cobra.Command {
+	generateCmd := &cobra.Command{
+		Use:   "generate <builder image> [<options>]",
+		Short: "Generate the Dockerfile of a source-to-image build.",
+		Long: "Generate a Dockerfile equivalent to the image s2i would build from the source directory with the builder\n" +
+			"image, based on the s2i labels of the builder image, the .s2i/bin scripts and .s2i/environment file of the\n" +
+			"source, and the environment variables given.  The builder image can be an image stream tag or image, in the\n" +
+			"[<namespace>/]<name> form, which is translated like 'obu translate' does, or a docker image reference.\n" +
+			"The builder image is inspected through the mirrors and with the insecure registry settings of the cluster,\n" +
+			"or of the registries.conf given.  The paths of the s2i scripts the Dockerfile runs are listed as\n" +
+			"<script>=<path>, on stdout when the Dockerfile is written to a file, and on stderr otherwise.",
+		Example: `
+# Print the Dockerfile for building the source in the current directory with the nodejs:12 builder image of the
+# openshift namespace
+$ obu s2i generate openshift/nodejs:12
+
+# Write it next to the source checked out in a Tekton workspace, and build it with buildah
+$ obu s2i generate openshift/nodejs:12 --context-dir $(workspaces.source.path) --env NPM_MIRROR=https://npm.example.com \
+    --output-file $(workspaces.source.path)/Dockerfile.s2i
+$ buildah bud -f $(workspaces.source.path)/Dockerfile.s2i -t $(params.IMAGE) $(workspaces.source.path)
+`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			clients, err := util.GetClients(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem with kubeconfig: %v\n", err)
+				return
+			}
+			namespace, err := util.GetNamespace(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			ref, err := parseNamespacedImageReference(args[0], namespace)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			// image streams are pinned to the image that is inspected; the digest of docker image references is not
+			// resolved, as their registry may well require credentials
+			translateCfg := *cfg
+			translateCfg.SHA = true
+			builder, err := translateObjectReference(&translateCfg, clients, ref)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem resolving builder image %s: %v\n", args[0], err)
+				return
+			}
+			imageConfig, err := getBuilderImageConfig(cfg, clients, namespace, builder)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			dockerfile, scripts, err := generateS2IDockerfile(cfg, builder, imageConfig)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+
+			scriptsOut := os.Stdout
+			if len(cfg.OutputFile) == 0 {
+				fmt.Fprintf(os.Stdout, "%s", dockerfile)
+				scriptsOut = os.Stderr
+			} else {
+				outputFile := util.GetTektonOutputFile(cfg.OutputFile, util.TektonWorkspaceDir)
+				if err := ioutil.WriteFile(outputFile, []byte(dockerfile), 0644); err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: problem writing Dockerfile to %s: %v\n", outputFile, err)
+					return
+				}
+			}
+			for _, script := range s2iScripts {
+				fmt.Fprintf(scriptsOut, "%s=%s\n", script, scripts[script])
+			}
+		},
+	}
+	generateCmd.Flags().StringVar(&(cfg.S2IContextDir), "context-dir", ".",
+		"The build context directory the Dockerfile is built with.")
+	generateCmd.Flags().StringVar(&(cfg.S2ISourceDir), "source-dir", ".",
+		"The directory of the source to build, relative to the context directory.")
+	generateCmd.Flags().StringArrayVar(&(cfg.S2IEnv), "env", cfg.S2IEnv,
+		"An environment variable for the build, as <name>=<value>, taking precedence over the source's .s2i/environment file.  Can be repeated.")
+	generateCmd.Flags().StringVar(&(cfg.S2IScriptsURL), "scripts-url", cfg.S2IScriptsURL,
+		"The image:// URL of the directory holding the s2i scripts in the builder image, instead of the one in its labels.")
+	generateCmd.Flags().StringVar(&(cfg.RegistriesConf), "registries-conf", cfg.RegistriesConf,
+		"The registries.conf whose mirrors and insecure registries apply to the builder image, instead of the one generated from the cluster's image config and image content source policies.")
+	defaultServiceAccount := "builder"
+	if util.IsTekton() {
+		defaultServiceAccount = util.TektonServiceAccount
+	}
+	generateCmd.Flags().StringVar(&(cfg.ServiceAccount), "service-account", defaultServiceAccount,
+		"The service account whose registry credentials are used to inspect the builder image.")
+	generateCmd.Flags().StringVar(&(cfg.OutputFile), "output-file", cfg.OutputFile,
+		"Write the Dockerfile to this file instead of stdout.  In a Tekton step, relative paths are under /workspace.")
+	return generateCmd
+}
+
+// getBuilderImageConfig inspects the builder image from each of the locations it can be pulled from in turn, i.e.
+// its mirrors, with the service account's credentials for the registry, if it has any, trusting the internal and
+// mirror registry CAs.
+func getBuilderImageConfig(cfg *api.Config, clients *util.Clients, namespace, builder string) (*util.ImageConfig, error) {
+	imageConfig, err := clients.Config.ConfigV1().Images().Get("cluster", metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("problem getting global image config: %v", err)
+	}
+	sources, err := getImagePullSources(cfg, clients, imageConfig, builder)
+	if err != nil {
+		return nil, err
+	}
+	dockerConfig, err := getMergedDockerConfig(cfg, clients, namespace)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: inspecting the builder image without credentials: %v\n", err)
+		dockerConfig = &DockerConfigJson{Auths: DockerConfig{}}
+	}
+	caData, _ := getImageRegistryCAData(clients)
+	if mirrorCAData, err := getMirrorRegistryCAData(clients, imageConfig); err == nil {
+		caData += mirrorCAData
+	}
+
+	for i, source := range sources {
+		image := source.Reference.String()
+		auth, err := getRegistryAuth(dockerConfig, dockerreference.Domain(source.Reference))
+		if err != nil {
+			return nil, err
+		}
+		builderConfig, err := util.GetImageConfig(image, auth, caData, source.Endpoint.Insecure)
+		if err == nil {
+			return builderConfig, nil
+		}
+		if i == len(sources)-1 {
+			return nil, fmt.Errorf("problem inspecting builder image %s: %v", image, err)
+		}
+		fmt.Fprintf(os.Stderr, "WARNING: problem inspecting builder image %s, trying the next location: %v\n", image, err)
+	}
+	return nil, fmt.Errorf("no location to pull builder image %s from", builder)
+}
+
+// getRegistryAuth returns the credentials for a registry host from a docker config, whose keys can also be URLs, as
+// with https://index.docker.io/v1/ for docker hub.
+func getRegistryAuth(dockerConfig *DockerConfigJson, host string) (*util.RegistryAuth, error) {
+	normalize := func(key string) string {
+		key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+		key = strings.SplitN(key, "/", 2)[0]
+		if dockerHubHosts[key] {
+			return "docker.io"
+		}
+		return key
+	}
+	keys := []string{}
+	for key := range dockerConfig.Auths {
+		keys = append(keys, key)
+	}
+	// an entry for exactly the host takes precedence over the other forms
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] == host || (keys[j] != host && keys[i] < keys[j])
+	})
+	for _, key := range keys {
+		if normalize(key) != normalize(host) {
+			continue
+		}
+		username, password, err := getDockerConfigEntryCredentials(dockerConfig.Auths[key])
+		if err != nil {
+			return nil, fmt.Errorf("problem decoding the credentials for %s: %v", key, err)
+		}
+		return &util.RegistryAuth{Username: username, Password: password}, nil
+	}
+	return nil, nil
+}
+
+// generateS2IDockerfile lays out the steps of an s2i build the way 's2i build --as-dockerfile' does: the source,
+// and any scripts it provides, are copied to the destination the builder image expects, owned by the assemble
+// user, which then runs the assemble script, with the run script as the command of the resulting image.  The paths
+// of the scripts that are run are returned along with the Dockerfile.
+func generateS2IDockerfile(cfg *api.Config, builder string, imageConfig *util.ImageConfig) (string, map[string]string, error) {
+	scriptsURL := cfg.S2IScriptsURL
+	for _, label := range []string{s2iScriptsURLLabel, s2iLegacyScriptsURLLabel} {
+		if len(scriptsURL) == 0 {
+			scriptsURL = imageConfig.Labels[label]
+		}
+	}
+	if len(scriptsURL) == 0 {
+		return "", nil, fmt.Errorf("builder image %s has no %s label, specify where its scripts are with --scripts-url", builder, s2iScriptsURLLabel)
+	}
+	// the scripts have to be in the builder image, as a Dockerfile build has no way of running downloaded ones as is
+	if !strings.HasPrefix(scriptsURL, "image://") {
+		return "", nil, fmt.Errorf("unsupported scripts URL %s, only image:// URLs can be used", scriptsURL)
+	}
+	scriptsDir := strings.TrimPrefix(scriptsURL, "image://")
+	destination := imageConfig.Labels[s2iDestinationLabel]
+	if len(destination) == 0 {
+		destination = s2iDefaultDestination
+	}
+	user := imageConfig.Labels[s2iAssembleUserLabel]
+	if len(user) == 0 {
+		user = imageConfig.User
+	}
+
+	sourceDir := filepath.ToSlash(filepath.Clean(cfg.S2ISourceDir))
+	localSourceDir := filepath.Join(cfg.S2IContextDir, cfg.S2ISourceDir)
+	scripts := map[string]string{}
+	sourceScripts := false
+	for _, script := range s2iScripts {
+		scripts[script] = path.Join(scriptsDir, script)
+		if _, err := os.Stat(filepath.Join(localSourceDir, s2iSourceScriptsDir, script)); err == nil {
+			scripts[script] = path.Join(destination, "scripts", script)
+			sourceScripts = true
+		}
+	}
+	env, err := getS2IEnv(cfg, filepath.Join(localSourceDir, s2iSourceEnvironmentFile))
+	if err != nil {
+		return "", nil, err
+	}
+
+	lines := []string{
+		"FROM " + builder,
+		fmt.Sprintf("LABEL %q=%q %q=%q", s2iBuildImageLabel, builder, s2iScriptsURLLabel, scriptsURL),
+	}
+	if len(env) > 0 {
+		vars := []string{}
+		for _, nameValue := range env {
+			vars = append(vars, fmt.Sprintf("%q=%q", nameValue[0], nameValue[1]))
+		}
+		lines = append(lines, "ENV "+strings.Join(vars, " \\\n    "))
+	}
+	copied := []string{path.Join(destination, "src")}
+	if len(user) > 0 {
+		lines = append(lines, "USER root")
+	}
+	lines = append(lines, "# Copying in source code", fmt.Sprintf("COPY %s %s", sourceDir, copied[0]))
+	if sourceScripts {
+		copied = append(copied, path.Join(destination, "scripts"))
+		lines = append(lines, "# Copying in the scripts of the source, which take precedence over those of the builder image",
+			fmt.Sprintf("COPY %s %s", path.Join(sourceDir, s2iSourceScriptsDir), copied[1]))
+	}
+	if len(user) > 0 {
+		lines = append(lines, "# Change file ownership to the assemble user",
+			fmt.Sprintf("RUN chown -R %s:0 %s", user, strings.Join(copied, " ")),
+			"USER "+user)
+	}
+	lines = append(lines,
+		"# Assemble script sourced from the builder image or source, which fails the build if it does not exist",
+		"RUN "+scripts["assemble"],
+		"# Run script sourced from the builder image or source",
+		"CMD "+scripts["run"])
+	return strings.Join(lines, "\n") + "\n", scripts, nil
+}
+
+// getS2IEnv combines the source's environment file with the --env options, which take precedence, sorted by name.
+func getS2IEnv(cfg *api.Config, environmentFile string) ([][2]string, error) {
+	values := map[string]string{}
+	if file, err := os.Open(environmentFile); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) == 0 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			nameValue := strings.SplitN(line, "=", 2)
+			if len(nameValue) != 2 {
+				return nil, fmt.Errorf("invalid line in %s: %s", environmentFile, line)
+			}
+			values[nameValue[0]] = nameValue[1]
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("problem reading %s: %v", environmentFile, err)
+		}
+	}
+	for _, env := range cfg.S2IEnv {
+		nameValue := strings.SplitN(env, "=", 2)
+		if len(nameValue) != 2 || len(nameValue[0]) == 0 {
+			return nil, fmt.Errorf("invalid environment variable %q, use <name>=<value>", env)
+		}
+		values[nameValue[0]] = nameValue[1]
+	}
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	env := [][2]string{}
+	for _, name := range names {
+		env = append(env, [2]string{name, values[name]})
+	}
+	return env, nil
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestGetRegistryAuth(t *testing.T) {
+	dockerConfig := &DockerConfigJson{Auths: DockerConfig{
+		"https://index.docker.io/v1/": DockerConfigEntry{Username: "hub", Password: "hubpass"},
+		"quay.io":                     DockerConfigEntry{Auth: "cXVheTpxdWF5cGFzcw=="},
+		"https://quay.io":             DockerConfigEntry{Username: "other", Password: "otherpass"},
+	}}
+	tests := []struct {
+		host     string
+		username string
+		password string
+	}{
+		{host: "docker.io", username: "hub", password: "hubpass"},
+		{host: "quay.io", username: "quay", password: "quaypass"},
+		{host: "mirror.local:5000"},
+	}
+	for _, test := range tests {
+		auth, err := getRegistryAuth(dockerConfig, test.host)
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %v", test.host, err)
+		}
+		if len(test.username) == 0 {
+			if auth != nil {
+				t.Errorf("expected no credentials for %s, got %#v", test.host, auth)
+			}
+			continue
+		}
+		if auth == nil || auth.Username != test.username || auth.Password != test.password {
+			t.Errorf("expected %s/%s for %s, got %#v", test.username, test.password, test.host, auth)
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+	"github.com/openshift/library-go/pkg/image/imageutil"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// buildEnvSnapshot is the build environment obu derives from the cluster, minus anything secret, in a form that can
+// be stored and compared.
+type buildEnvSnapshot struct {
+	Time           string `json:"time"`
+	Namespace      string `json:"namespace"`
+	ServiceAccount string `json:"serviceAccount"`
+	// the proxy environment variables, keyed by their upper case names
+	Proxy          map[string]string `json:"proxy,omitempty"`
+	CACertificates []caFingerprint   `json:"caCertificates,omitempty"`
+	RegistriesConf string            `json:"registriesConf"`
+	// the registries the service account has credentials for
+	AuthHosts []string `json:"authHosts,omitempty"`
+	// the translated reference of each image stream tag, keyed by <namespace>/<stream>:<tag>
+	ImageStreamTags map[string]string `json:"imageStreamTags,omitempty"`
+}
+
+type caFingerprint struct {
+	// where the certificate came from: proxy, internal-registry or mirror-registries
+	Source   string `json:"source"`
+	Subject  string `json:"subject"`
+	SHA256   string `json:"sha256"`
+	NotAfter string `json:"notAfter"`
+}
+
+func (ca caFingerprint) String() string {
+	if len(ca.NotAfter) == 0 {
+		return fmt.Sprintf("%s %s (sha256 %s)", ca.Source, ca.Subject, ca.SHA256)
+	}
+	return fmt.Sprintf("%s %s (sha256 %s, expires %s)", ca.Source, ca.Subject, ca.SHA256, ca.NotAfter)
+}
+
+func NewCmdSnapshot(cfg *api.Config) *cobra.Command {
+	snapshotCmd := &cobra.Command{
+		Use:   "snapshot [<options>]",
+		Short: "Capture the build environment derived from the cluster.",
+		Long: "Capture the proxy settings, the fingerprints of the proxy, internal registry and mirror registry CAs, the\n" +
+			"mirrors registries.conf, the registries the service account has credentials for and the image each image\n" +
+			"stream tag resolves to, as JSON, so that it can later be compared with 'obu diff'.  No credentials are captured.",
+		Example: `
+# Capture the build environment of the 'builder' service account in the current namespace, along with the
+# image stream tags of the 'openshift' namespace builder images live in
+$ obu snapshot --image-stream-namespace openshift --output-file before.json
+
+# Compare it with the live cluster once builds start failing
+$ obu diff before.json
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			clients, err := util.GetClients(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem with kubeconfig: %v\n", err)
+				return
+			}
+			namespace, err := util.GetNamespace(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			snapshot, err := getBuildEnvSnapshot(cfg, clients, namespace)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			data, err := json.MarshalIndent(snapshot, "", "  ")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem encoding snapshot: %v\n", err)
+				return
+			}
+			if len(cfg.OutputFile) > 0 {
+				if err := ioutil.WriteFile(cfg.OutputFile, data, 0644); err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: problem writing snapshot to %s: %v\n", cfg.OutputFile, err)
+				}
+				return
+			}
+			fmt.Fprintf(os.Stdout, "%s\n", data)
+		},
+	}
+	addSnapshotFlags(snapshotCmd, cfg)
+	snapshotCmd.Flags().StringVar(&(cfg.OutputFile), "output-file", cfg.OutputFile,
+		"Write the snapshot to this file instead of stdout.")
+	return snapshotCmd
+}
+
+func NewCmdDiff(cfg *api.Config) *cobra.Command {
+	diffCmd := &cobra.Command{
+		Use:   "diff <snapshot> [<snapshot>] [<options>]",
+		Short: "Compare build environment snapshots.",
+		Long: "Show what changed between two snapshots taken with 'obu snapshot', or with a single snapshot, between it and\n" +
+			"the live cluster.  The live cluster is captured for the namespace and service account of the snapshot.",
+		Example: `
+# Compare two snapshots
+$ obu diff before.json after.json
+
+# Compare a snapshot with the live cluster
+$ obu diff before.json --image-stream-namespace openshift
+`,
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			before, err := readBuildEnvSnapshot(args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			var after *buildEnvSnapshot
+			if len(args) == 2 {
+				after, err = readBuildEnvSnapshot(args[1])
+			} else {
+				after, err = getLiveBuildEnvSnapshot(cfg, before, cmd.Flags().Changed("service-account"))
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			diff := diffBuildEnvSnapshots(before, after)
+			if len(diff) == 0 {
+				fmt.Fprintf(os.Stdout, "no differences\n")
+				return
+			}
+			fmt.Fprintf(os.Stdout, "%s", strings.Join(diff, ""))
+		},
+	}
+	addSnapshotFlags(diffCmd, cfg)
+	return diffCmd
+}
+
+func addSnapshotFlags(cmd *cobra.Command, cfg *api.Config) {
+	defaultServiceAccount := "builder"
+	if util.IsTekton() {
+		defaultServiceAccount = util.TektonServiceAccount
+	}
+	cmd.Flags().StringVar(&(cfg.ServiceAccount), "service-account", defaultServiceAccount,
+		"The service account whose registry credentials are captured.")
+	cmd.Flags().StringSliceVar(&(cfg.SnapshotNamespaces), "image-stream-namespace", cfg.SnapshotNamespaces,
+		"Also capture the image stream tags of this namespace, in addition to those of the current namespace.  Can be repeated.")
+}
+
+func readBuildEnvSnapshot(path string) (*buildEnvSnapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("problem reading snapshot %s: %v", path, err)
+	}
+	snapshot := &buildEnvSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("problem parsing snapshot %s: %v", path, err)
+	}
+	return snapshot, nil
+}
+
+// getLiveBuildEnvSnapshot captures the cluster the way the earlier snapshot was captured, unless the namespace or
+// service account were explicitly specified.
+func getLiveBuildEnvSnapshot(cfg *api.Config, earlier *buildEnvSnapshot, serviceAccountSet bool) (*buildEnvSnapshot, error) {
+	clients, err := util.GetClients(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("problem with kubeconfig: %v", err)
+	}
+	namespace := earlier.Namespace
+	if cfg.ConfigFlags.Namespace != nil && len(*cfg.ConfigFlags.Namespace) > 0 {
+		namespace = *cfg.ConfigFlags.Namespace
+	}
+	if len(namespace) == 0 {
+		if namespace, err = util.GetNamespace(cfg); err != nil {
+			return nil, err
+		}
+	}
+	liveCfg := *cfg
+	if len(earlier.ServiceAccount) > 0 && !serviceAccountSet {
+		liveCfg.ServiceAccount = earlier.ServiceAccount
+	}
+	// capture the same image stream namespaces the earlier snapshot has tags from
+	for key := range earlier.ImageStreamTags {
+		if ns := strings.SplitN(key, "/", 2)[0]; ns != namespace {
+			liveCfg.SnapshotNamespaces = append(liveCfg.SnapshotNamespaces, ns)
+		}
+	}
+	return getBuildEnvSnapshot(&liveCfg, clients, namespace)
+}
+
+func getBuildEnvSnapshot(cfg *api.Config, clients *util.Clients, namespace string) (*buildEnvSnapshot, error) {
+	snapshot := &buildEnvSnapshot{
+		Time:            time.Now().UTC().Format(time.RFC3339),
+		Namespace:       namespace,
+		ServiceAccount:  cfg.ServiceAccount,
+		Proxy:           map[string]string{},
+		AuthHosts:       []string{},
+		ImageStreamTags: map[string]string{},
+	}
+
+	// builds get the default proxy of the cluster's build config, which takes precedence over the global proxy
+	proxy, err := getEffectiveProxy(clients, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range map[string]string{
+		"HTTP_PROXY":  proxy.HTTPProxy.Value,
+		"HTTPS_PROXY": proxy.HTTPSProxy.Value,
+		"NO_PROXY":    proxy.NoProxy.Value,
+	} {
+		if len(value) > 0 {
+			snapshot.Proxy[name] = value
+		}
+	}
+
+	imageConfig, err := clients.Config.ConfigV1().Images().Get("cluster", metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("problem getting global image config: %v", err)
+	}
+	snapshot.RegistriesConf, err = getBuildRegistriesConfigData(clients, imageConfig)
+	if err != nil {
+		return nil, fmt.Errorf("problem building registry config: %v", err)
+	}
+
+	// missing CAs and credentials are part of the environment, so they are simply not captured
+	if caData, err := getGlobalProxyCAData(clients); err == nil {
+		snapshot.CACertificates = append(snapshot.CACertificates, getCAFingerprints("proxy", caData)...)
+	}
+	if caData, err := getImageRegistryCAData(clients); err == nil {
+		snapshot.CACertificates = append(snapshot.CACertificates, getCAFingerprints("internal-registry", caData)...)
+	}
+	if caData, err := getMirrorRegistryCAData(clients, imageConfig); err == nil {
+		snapshot.CACertificates = append(snapshot.CACertificates, getCAFingerprints("mirror-registries", caData)...)
+	}
+	if dockerConfig, err := getMergedDockerConfig(cfg, clients, namespace); err == nil {
+		for hostPort := range dockerConfig.Auths {
+			snapshot.AuthHosts = append(snapshot.AuthHosts, hostPort)
+		}
+		sort.Strings(snapshot.AuthHosts)
+	} else {
+		fmt.Fprintf(os.Stderr, "WARNING: not capturing registry credentials: %v\n", err)
+	}
+
+	namespaces := map[string]bool{namespace: true}
+	for _, ns := range cfg.SnapshotNamespaces {
+		namespaces[ns] = true
+	}
+	for ns := range namespaces {
+		streams, err := clients.Image.ImageV1().ImageStreams(ns).List(metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("problem listing image streams in namespace %s: %v", ns, err)
+		}
+		for i := range streams.Items {
+			is := &streams.Items[i]
+			for _, tag := range is.Status.Tags {
+				img, err := translateImageStreamTag(cfg, is, tag.Tag)
+				if err != nil {
+					continue
+				}
+				snapshot.ImageStreamTags[ns+"/"+imageutil.JoinImageStreamTag(is.Name, tag.Tag)] = img
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+// getCAFingerprints identifies each certificate of a PEM bundle by the SHA-256 hash of its DER encoding
+func getCAFingerprints(source, caData string) []caFingerprint {
+	fingerprints := []caFingerprint{}
+	rest := []byte(caData)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		sum := sha256.Sum256(block.Bytes)
+		fingerprint := caFingerprint{Source: source, SHA256: hex.EncodeToString(sum[:])}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			fingerprint.Subject = cert.Subject.String()
+			fingerprint.NotAfter = cert.NotAfter.UTC().Format(time.RFC3339)
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	// content that is not PEM at all still has to show up as a difference when it changes
+	if len(fingerprints) == 0 && len(strings.TrimSpace(caData)) > 0 {
+		sum := sha256.Sum256([]byte(caData))
+		fingerprints = append(fingerprints, caFingerprint{Source: source, Subject: "<not PEM encoded>", SHA256: hex.EncodeToString(sum[:])})
+	}
+	return fingerprints
+}
+
+// diffBuildEnvSnapshots lists, section by section, what was added (+), removed (-) and changed (~) from before to
+// after.  The time the snapshots were taken is not considered a difference.
+func diffBuildEnvSnapshots(before, after *buildEnvSnapshot) []string {
+	diff := []string{}
+	section := func(title string, lines []string) {
+		if len(lines) > 0 {
+			diff = append(diff, title+":\n")
+			diff = append(diff, lines...)
+		}
+	}
+
+	settings := []string{}
+	if before.Namespace != after.Namespace {
+		settings = append(settings, fmt.Sprintf("  ~ namespace: %s -> %s\n", before.Namespace, after.Namespace))
+	}
+	if before.ServiceAccount != after.ServiceAccount {
+		settings = append(settings, fmt.Sprintf("  ~ service account: %s -> %s\n", before.ServiceAccount, after.ServiceAccount))
+	}
+	section("snapshot", settings)
+	section("proxy", diffStringMaps(before.Proxy, after.Proxy))
+
+	beforeCAs := map[string]string{}
+	for _, ca := range before.CACertificates {
+		beforeCAs[ca.Source+" "+ca.SHA256] = ca.String()
+	}
+	afterCAs := map[string]string{}
+	for _, ca := range after.CACertificates {
+		afterCAs[ca.Source+" "+ca.SHA256] = ca.String()
+	}
+	section("CA certificates", diffStringSets(beforeCAs, afterCAs))
+
+	if before.RegistriesConf != after.RegistriesConf {
+		section("registries.conf", diffLines(before.RegistriesConf, after.RegistriesConf))
+	}
+
+	beforeHosts := map[string]string{}
+	for _, host := range before.AuthHosts {
+		beforeHosts[host] = host
+	}
+	afterHosts := map[string]string{}
+	for _, host := range after.AuthHosts {
+		afterHosts[host] = host
+	}
+	section("registry credentials", diffStringSets(beforeHosts, afterHosts))
+	section("image stream tags", diffStringMaps(before.ImageStreamTags, after.ImageStreamTags))
+	return diff
+}
+
+func sortedKeys(maps ...map[string]string) []string {
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, m := range maps {
+		for key := range m {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func diffStringMaps(before, after map[string]string) []string {
+	lines := []string{}
+	for _, key := range sortedKeys(before, after) {
+		oldValue, inBefore := before[key]
+		newValue, inAfter := after[key]
+		switch {
+		case !inBefore:
+			lines = append(lines, fmt.Sprintf("  + %s: %s\n", key, newValue))
+		case !inAfter:
+			lines = append(lines, fmt.Sprintf("  - %s: %s\n", key, oldValue))
+		case oldValue != newValue:
+			lines = append(lines, fmt.Sprintf("  ~ %s: %s -> %s\n", key, oldValue, newValue))
+		}
+	}
+	return lines
+}
+
+// diffStringSets compares sets keyed by identity, printing the description of the entries only in one of them
+func diffStringSets(before, after map[string]string) []string {
+	lines := []string{}
+	for _, key := range sortedKeys(before, after) {
+		_, inBefore := before[key]
+		_, inAfter := after[key]
+		switch {
+		case !inBefore:
+			lines = append(lines, fmt.Sprintf("  + %s\n", after[key]))
+		case !inAfter:
+			lines = append(lines, fmt.Sprintf("  - %s\n", before[key]))
+		}
+	}
+	return lines
+}
+
+// diffLines is a minimal line based diff, from the longest common subsequence of the two texts
+func diffLines(before, after string) []string {
+	a := strings.Split(strings.TrimRight(before, "\n"), "\n")
+	b := strings.Split(strings.TrimRight(after, "\n"), "\n")
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	lines := []string{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, fmt.Sprintf("  - %s\n", a[i]))
+			i++
+		default:
+			lines = append(lines, fmt.Sprintf("  + %s\n", b[j]))
+			j++
+		}
+	}
+	return lines
+}
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+	configinformers "github.com/openshift/client-go/config/informers/externalversions"
+	operatorinformers "github.com/openshift/client-go/operator/informers/externalversions"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/tools/cache"
+)
+
+func NewCmdSync(cfg *api.Config) *cobra.Command {
+	syncCmd := &cobra.Command{
+		Use:   "sync [<options>]",
+		Short: "Store the build configuration in a ConfigMap and Secret.",
+		Long: "Write the cluster's proxy settings, a CA bundle with the proxy, internal registry and mirror registry CAs,\n" +
+			"and the mirrors registries.conf into the '" + buildConfigMapNamePrefix + "<service account>' ConfigMap, and the\n" +
+			"registry credentials of the service account into the '" + buildAuthSecretNamePrefix + "<service account>'\n" +
+			"dockerconfigjson Secret, so that Tasks can simply mount them.  They are only updated when their contents change.",
+		Example: `
+# Store the build configuration for the 'builder' service account in the current namespace
+$ obu sync
+
+# Store it for the 'pipeline' service account in the 'demo' namespace, and keep it up to date as the cluster's
+# proxy, build, image and image content source policy configuration changes
+$ obu sync -n demo --service-account pipeline --watch
+
+# Mount them in a Task step run as the 'pipeline' service account
+  steps:
+  - name: build
+    envFrom:
+    - configMapRef: {name: obu-build-config-pipeline}
+    env:
+    - {name: REGISTRY_AUTH_FILE, value: /var/run/obu/build-auth/.dockerconfigjson}
+    volumeMounts:
+    - {name: obu-build-config, mountPath: /etc/containers/registries.conf, subPath: registries.conf}
+    - {name: obu-build-auth, mountPath: /var/run/obu/build-auth}
+  volumes:
+  - {name: obu-build-config, configMap: {name: obu-build-config-pipeline}}
+  - {name: obu-build-auth, secret: {secretName: obu-build-auth-pipeline}}
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			clients, err := util.GetClients(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem with kubeconfig: %v\n", err)
+				return
+			}
+			namespace, err := util.GetNamespace(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			if !cfg.Watch {
+				if err := syncBuildConfig(cfg, clients, namespace); err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				}
+				return
+			}
+			watchBuildConfig(cfg, clients, namespace)
+		},
+	}
+	defaultServiceAccount := "builder"
+	if util.IsTekton() {
+		defaultServiceAccount = util.TektonServiceAccount
+	}
+	syncCmd.Flags().StringVar(&(cfg.ServiceAccount), "service-account", defaultServiceAccount,
+		"The service account whose registry credentials are stored.")
+	syncCmd.Flags().BoolVar(&(cfg.Watch), "watch", cfg.Watch,
+		"Keep running, and update the ConfigMap and Secret whenever the cluster's Proxy, Build, Image or ImageContentSourcePolicy objects change.")
+	syncCmd.Flags().DurationVar(&(cfg.WatchResync), "watch-resync", 10*time.Minute,
+		"With --watch, how often to also sync regardless of changes, which picks up changed CAs and credentials.")
+	return syncCmd
+}
+
+func syncBuildConfig(cfg *api.Config, clients *util.Clients, namespace string) error {
+	data, err := getBuildConfigData(cfg, clients, namespace)
+	if err != nil {
+		return err
+	}
+	results, err := applyBuildConfig(clients, newBuildConfigMap(namespace, cfg.ServiceAccount, data), newBuildAuthSecret(namespace, cfg.ServiceAccount, data))
+	for _, result := range results {
+		// with --watch, the periodic resyncs would otherwise flood the output
+		if cfg.Watch && strings.HasSuffix(result, " unchanged") {
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", result)
+	}
+	return err
+}
+
+// watchBuildConfig syncs once, then again whenever the cluster configuration the build configuration derives from
+// changes, until obu is told to stop.  Failed syncs are only reported, the next change or resync retries them.
+func watchBuildConfig(cfg *api.Config, clients *util.Clients, namespace string) {
+	configFactory := configinformers.NewSharedInformerFactory(clients.Config, cfg.WatchResync)
+	operatorFactory := operatorinformers.NewSharedInformerFactory(clients.Operator, cfg.WatchResync)
+
+	// a pending sync covers every change made before it runs, so changes only need to be recorded once
+	changes := make(chan struct{}, 1)
+	changes <- struct{}{}
+	changed := func(obj interface{}) {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    changed,
+		UpdateFunc: func(old, new interface{}) { changed(new) },
+		DeleteFunc: changed,
+	}
+	informers := []cache.SharedIndexInformer{
+		configFactory.Config().V1().Proxies().Informer(),
+		configFactory.Config().V1().Images().Informer(),
+		configFactory.Config().V1().Builds().Informer(),
+		operatorFactory.Operator().V1alpha1().ImageContentSourcePolicies().Informer(),
+	}
+	for _, informer := range informers {
+		informer.AddEventHandler(handler)
+	}
+
+	stop := util.SetupSignalHandler()
+	configFactory.Start(stop)
+	operatorFactory.Start(stop)
+	configFactory.WaitForCacheSync(stop)
+	operatorFactory.WaitForCacheSync(stop)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-changes:
+			if err := syncBuildConfig(cfg, clients, namespace); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	obuImage          = "quay.io/gabemontero/obu:latest"
+	outputWorkspace   = "output"
+	tektonTaskVersion = "0.1"
+)
+
+// taskOutput is one invocation of an obu verb in a generated Task, with the options that select what it prints,
+// and the Task result or file in the output workspace the printed content is stored in
+type taskOutput struct {
+	args        []string
+	result      string
+	file        string
+	description string
+	// the verb writes the output to the path following args itself, rather than printing it
+	pathArg bool
+}
+
+// taskVerb describes how an obu verb is turned into a Task.  Its params come from the verb's flags, other than
+// those used to select outputs and those in exclude.
+type taskVerb struct {
+	verb string
+	// positional argument of the verb, as a param name, if any
+	arg            string
+	argDescription string
+	outputs        []taskOutput
+	exclude        []string
+}
+
+var taskVerbs = []taskVerb{
+	{
+		verb:           "translate",
+		arg:            "reference",
+		argDescription: "The image stream tag, image stream image or docker image reference to translate, unless from-reference is set.",
+		outputs: []taskOutput{
+			{args: []string{"--output-file"}, result: "image", description: "The translated image pull spec.", pathArg: true},
+		},
+		// --watch never completes, and the output file is the result
+		exclude: []string{"watch", "watch-resync", "output-file"},
+	},
+	{
+		verb: "proxy",
+		outputs: []taskOutput{
+			{args: []string{"--http-proxy"}, result: "http-proxy", description: "The cluster's HTTP proxy, if any."},
+			{args: []string{"--https-proxy"}, result: "https-proxy", description: "The cluster's HTTPS proxy, if any."},
+			{args: []string{"--no-proxy"}, result: "no-proxy", description: "The hosts the cluster's proxies are not used for."},
+			{args: []string{"--env-vars"}, file: "proxy.env", description: "The proxy environment variables, one per line."},
+			{args: []string{"--ca-data"}, file: "proxy-ca.crt", description: "The CA bundle for the cluster's proxies."},
+		},
+	},
+	{
+		verb: "registry",
+		outputs: []taskOutput{
+			{args: []string{"--docker-cfg-file", "--output-file"}, file: "config.json", description: "The docker config file for the internal image registry.", pathArg: true},
+			{args: []string{"--ca-data"}, file: "registry-ca.crt", description: "The CA for the internal image registry."},
+		},
+		// installing writes to the step's own file system, which does not outlive it, and the credentials are
+		// written to the output workspace rather than printed
+		exclude: []string{"install", "redact"},
+	},
+	{
+		verb: "mirror",
+		outputs: []taskOutput{
+			{args: []string{"--docker-cfg-file"}, file: "registries.conf", description: "The registries.conf applying the cluster's mirrors."},
+			{args: []string{"--ca-data"}, file: "mirror-ca.crt", description: "The CAs for the cluster's mirror registries."},
+		},
+	},
+}
+
+// setupTaskVerbs are combined into the 'setup' Task, which prepares everything a build tool needs in one go
+var setupTaskVerbs = []string{"proxy", "registry", "mirror"}
+
+// tektonParamDefaults are the flag defaults that differ when obu runs in a Tekton step, which is where the Tasks run
+var tektonParamDefaults = map[string]string{
+	"service-account": util.TektonServiceAccount,
+}
+
+func NewCmdTekton(cfg *api.Config) *cobra.Command {
+	tektonCmd := &cobra.Command{
+		Use:   "tekton",
+		Short: "Integrate obu with Tekton.",
+		Long:  "Produce the Tekton resources that run the obu verbs.",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+	tektonCmd.AddCommand(NewCmdTektonGenerateTasks(cfg))
+	return tektonCmd
+}
+
+func NewCmdTektonGenerateTasks(cfg *api.Config) *cobra.Command {
+	generateCmd := &cobra.Command{
+		Use:   "generate-tasks [<options>]",
+		Short: "Generate Tekton Tasks for the obu verbs.",
+		Long: "Generate a Tekton Task for each of the translate, proxy, registry and mirror verbs, plus a 'setup' Task\n" +
+			"combining proxy, registry and mirror, with params generated from the verbs' options.",
+		Example: `
+# Print the Tasks, running the latest obu image pinned by digest
+$ obu tekton generate-tasks
+
+# Write the Tasks to ./tasks/<task>/<version>/<task>.yaml, like the Tekton catalog lays them out
+$ obu tekton generate-tasks --output-dir ./tasks --task-version 0.2 --image quay.io/gabemontero/obu:v0.2
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			image, err := util.ResolveDigest(cfg.TaskImage)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem pinning %s by digest: %v\n", cfg.TaskImage, err)
+				return
+			}
+			tasks, err := generateTasks(cmd.Root(), image, cfg.TaskVersion)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			for i, task := range tasks {
+				data, err := yaml.Marshal(task)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: problem encoding task %s: %v\n", task.Name, err)
+					return
+				}
+				if len(cfg.TaskOutputDir) == 0 {
+					if i > 0 {
+						fmt.Fprintf(os.Stdout, "---\n")
+					}
+					fmt.Fprintf(os.Stdout, "%s", data)
+					continue
+				}
+				dir := filepath.Join(cfg.TaskOutputDir, task.Name, cfg.TaskVersion)
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: problem creating %s: %v\n", dir, err)
+					return
+				}
+				path := filepath.Join(dir, task.Name+".yaml")
+				if err := ioutil.WriteFile(path, data, 0644); err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: problem writing %s: %v\n", path, err)
+					return
+				}
+				fmt.Fprintf(os.Stdout, "%s\n", path)
+			}
+		},
+	}
+	generateCmd.Flags().StringVar(&(cfg.TaskImage), "image", obuImage,
+		"The obu image the Tasks run, which is pinned by digest if it is not already.")
+	generateCmd.Flags().StringVar(&(cfg.TaskVersion), "task-version", tektonTaskVersion,
+		"The version recorded on the Tasks.")
+	generateCmd.Flags().StringVar(&(cfg.TaskOutputDir), "output-dir", cfg.TaskOutputDir,
+		"Write each Task to <output-dir>/<task>/<version>/<task>.yaml instead of stdout.")
+	return generateCmd
+}
+
+// the subset of the Tekton v1beta1 Task API the generated Tasks use, so that obu does not need to depend on Tekton
+
+type tektonTask struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              tektonTaskSpec `json:"spec"`
+
+	outputFiles []string
+}
+
+type tektonTaskSpec struct {
+	Description string            `json:"description,omitempty"`
+	Params      []tektonParamSpec `json:"params,omitempty"`
+	Results     []tektonResult    `json:"results,omitempty"`
+	Workspaces  []tektonWorkspace `json:"workspaces,omitempty"`
+	Steps       []tektonStep      `json:"steps"`
+}
+
+type tektonParamSpec struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+	Default     string `json:"default"`
+}
+
+type tektonResult struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type tektonWorkspace struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type tektonStep struct {
+	Name   string      `json:"name"`
+	Image  string      `json:"image"`
+	Env    []tektonEnv `json:"env,omitempty"`
+	Script string      `json:"script"`
+}
+
+type tektonEnv struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func generateTasks(root *cobra.Command, image, version string) ([]*tektonTask, error) {
+	tasks := []*tektonTask{}
+	verbs := map[string]taskVerb{}
+	commands := map[string]*cobra.Command{}
+	for _, tv := range taskVerbs {
+		verbCmd, _, err := root.Find([]string{tv.verb})
+		if err != nil || verbCmd == root {
+			return nil, fmt.Errorf("obu has no %s verb", tv.verb)
+		}
+		verbs[tv.verb] = tv
+		commands[tv.verb] = verbCmd
+		task := newTektonTask("obu-"+tv.verb, version, verbCmd.Short+"\n\n"+verbCmd.Long)
+		addTaskVerb(task, tv, verbCmd, image)
+		tasks = append(tasks, task)
+	}
+
+	setup := newTektonTask("obu-setup", version,
+		"Prepare the proxy, internal registry and mirror configuration a build tool needs in the output workspace.")
+	for _, verb := range setupTaskVerbs {
+		addTaskVerb(setup, verbs[verb], commands[verb], image)
+	}
+	return append(tasks, setup), nil
+}
+
+func newTektonTask(name, version, description string) *tektonTask {
+	return &tektonTask{
+		TypeMeta: metav1.TypeMeta{APIVersion: "tekton.dev/v1beta1", Kind: "Task"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"app.kubernetes.io/version": version},
+			Annotations: map[string]string{
+				"tekton.dev/pipelines.minVersion": "0.12.1",
+				"tekton.dev/tags":                 "build",
+			},
+		},
+		Spec: tektonTaskSpec{Description: strings.TrimSpace(description)},
+	}
+}
+
+// addTaskVerb adds a step running the verb once per output to the task, along with the params for the verb's
+// options, and the results and workspace the outputs go to.
+func addTaskVerb(task *tektonTask, tv taskVerb, verbCmd *cobra.Command, image string) {
+	excluded := map[string]bool{}
+	for _, name := range tv.exclude {
+		excluded[name] = true
+	}
+	for _, output := range tv.outputs {
+		for _, arg := range output.args {
+			excluded[strings.TrimPrefix(arg, "--")] = true
+		}
+	}
+
+	env := []tektonEnv{}
+	script := []string{"#!/usr/bin/env bash", "set -e", "args=()"}
+	if len(tv.arg) > 0 {
+		task.addParam(tektonParamSpec{Name: tv.arg, Type: "string", Description: tv.argDescription})
+		envName := paramEnvName(tv.arg)
+		env = append(env, tektonEnv{Name: envName, Value: fmt.Sprintf("$(params.%s)", tv.arg)})
+		script = append(script, fmt.Sprintf(`if [ -n "${%s}" ]; then args+=("${%s}"); fi`, envName, envName))
+	}
+	verbCmd.LocalNonPersistentFlags().VisitAll(func(flag *pflag.Flag) {
+		if excluded[flag.Name] || flag.Name == "help" || flag.Hidden {
+			return
+		}
+		defaultValue := flag.DefValue
+		if tektonDefault, ok := tektonParamDefaults[flag.Name]; ok {
+			defaultValue = tektonDefault
+		}
+		if strings.HasSuffix(flag.Value.Type(), "Slice") && defaultValue == "[]" {
+			defaultValue = ""
+		}
+		task.addParam(tektonParamSpec{Name: flag.Name, Type: "string", Description: flag.Usage, Default: defaultValue})
+		envName := paramEnvName(flag.Name)
+		env = append(env, tektonEnv{Name: envName, Value: fmt.Sprintf("$(params.%s)", flag.Name)})
+		// only pass the options that were changed, as some verbs behave differently when an option is set explicitly
+		script = append(script, fmt.Sprintf(`if [ "${%s}" != %q ]; then args+=("--%s=${%s}"); fi`,
+			envName, defaultValue, flag.Name, envName))
+	})
+
+	for _, output := range tv.outputs {
+		path := ""
+		if len(output.result) > 0 {
+			task.Spec.Results = append(task.Spec.Results, tektonResult{Name: output.result, Description: output.description})
+			path = fmt.Sprintf(`"$(results.%s.path)"`, output.result)
+		} else {
+			task.addOutputFile(output.file)
+			path = fmt.Sprintf(`"$(workspaces.%s.path)/%s"`, outputWorkspace, output.file)
+		}
+		redirect := "> "
+		if output.pathArg {
+			redirect = ""
+		}
+		script = append(script, fmt.Sprintf(`obu %s "${args[@]}" %s %s%s`, tv.verb, strings.Join(output.args, " "), redirect, path))
+	}
+
+	task.Spec.Steps = append(task.Spec.Steps, tektonStep{
+		Name:   tv.verb,
+		Image:  image,
+		Env:    env,
+		Script: strings.Join(script, "\n") + "\n",
+	})
+}
+
+// addParam adds a param unless a previous verb of a combined task already has one by the same name
+func (t *tektonTask) addParam(param tektonParamSpec) {
+	for _, existing := range t.Spec.Params {
+		if existing.Name == param.Name {
+			return
+		}
+	}
+	t.Spec.Params = append(t.Spec.Params, param)
+}
+
+// addOutputFile records a file written to the output workspace, adding the workspace for the first one
+func (t *tektonTask) addOutputFile(file string) {
+	t.outputFiles = append(t.outputFiles, file)
+	description := "Where the " + strings.Join(t.outputFiles, ", ") + " files are written."
+	for i, existing := range t.Spec.Workspaces {
+		if existing.Name == outputWorkspace {
+			t.Spec.Workspaces[i].Description = description
+			return
+		}
+	}
+	t.Spec.Workspaces = append(t.Spec.Workspaces, tektonWorkspace{Name: outputWorkspace, Description: description})
+}
+
+func paramEnvName(param string) string {
+	return "PARAM_" + strings.ToUpper(strings.Replace(param, "-", "_", -1))
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gabemontero/obu/pkg/api"
+	imagev1 "github.com/openshift/api/image/v1"
+	imageclientv1 "github.com/openshift/client-go/image/clientset/versioned/typed/image/v1"
+	"github.com/openshift/library-go/pkg/image/imageutil"
+	imagehelpers "github.com/openshift/oc/pkg/helpers/image"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const importPollInterval = time.Second
+
+// importImageStreamTag does the equivalent of 'oc import-image' for a single tag, and then waits for the image
+// stream status to reflect a successful import.  The stream can be nil if it does not exist yet, in which case the
+// import source must have been specified.
+func importImageStreamTag(cfg *api.Config, imageClient imageclientv1.ImageV1Interface, namespace, stream, tag string, is *imagev1.ImageStream) (*imagev1.ImageStream, error) {
+	istName := stream + ":" + tag
+	importSpec := imagev1.ImageImportSpec{
+		To: &corev1.LocalObjectReference{Name: tag},
+	}
+	switch {
+	case len(cfg.ImportFrom) > 0:
+		importSpec.From = corev1.ObjectReference{Kind: "DockerImage", Name: cfg.ImportFrom}
+	case is != nil:
+		// aliases are imported through the tag they ultimately point to
+		finalTag, tagRef, _, err := imagehelpers.FollowTagReference(is, tag)
+		if err != nil {
+			return nil, fmt.Errorf("image stream tag %s had tag reference error: %v", istName, err)
+		}
+		if tagRef.From == nil || tagRef.From.Kind != "DockerImage" {
+			return nil, fmt.Errorf("image stream tag %s does not reference an external image to import, use --import-from", istName)
+		}
+		importSpec.From = *tagRef.From
+		importSpec.To.Name = finalTag
+		importSpec.ImportPolicy = tagRef.ImportPolicy
+		importSpec.ReferencePolicy = tagRef.ReferencePolicy
+	default:
+		return nil, fmt.Errorf("image stream %s does not exist, use --import-from to specify what to import", stream)
+	}
+
+	isi := &imagev1.ImageStreamImport{
+		ObjectMeta: metav1.ObjectMeta{Name: stream, Namespace: namespace},
+		Spec: imagev1.ImageStreamImportSpec{
+			Import: true,
+			Images: []imagev1.ImageImportSpec{importSpec},
+		},
+	}
+	if is != nil {
+		isi.ResourceVersion = is.ResourceVersion
+	}
+	result, err := imageClient.ImageStreamImports(namespace).Create(isi)
+	if err != nil {
+		return nil, fmt.Errorf("problem importing image stream tag %s: %v", istName, err)
+	}
+	for _, image := range result.Status.Images {
+		if image.Status.Status != metav1.StatusSuccess {
+			return nil, fmt.Errorf("import of %s for image stream tag %s failed: %s", importSpec.From.Name, istName, image.Status.Message)
+		}
+	}
+
+	var imported *imagev1.ImageStream
+	err = wait.PollImmediate(importPollInterval, cfg.ImportTimeout, func() (bool, error) {
+		current, err := imageClient.ImageStreams(namespace).Get(stream, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		done, err := tagImportComplete(current, importSpec.To.Name)
+		if done {
+			imported = current
+		}
+		return done, err
+	})
+	if err == wait.ErrWaitTimeout {
+		return nil, fmt.Errorf("timed out after %s waiting for image stream tag %s to be imported", cfg.ImportTimeout, istName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return imported, nil
+}
+
+// tagImportComplete determines whether the status of the image stream reflects the latest spec generation of the
+// tag, returning an error if the import for that generation failed.
+func tagImportComplete(is *imagev1.ImageStream, tag string) (bool, error) {
+	specGeneration := int64(0)
+	if tagRef, ok := imageutil.SpecHasTag(is, tag); ok && tagRef.Generation != nil {
+		specGeneration = *tagRef.Generation
+	}
+	for _, condition := range getTagConditions(is, tag) {
+		if condition.Type == imagev1.ImportSuccess && condition.Status == corev1.ConditionFalse && condition.Generation >= specGeneration {
+			return false, fmt.Errorf("import of image stream tag %s:%s failed with %s: %s", is.Name, tag, condition.Reason, condition.Message)
+		}
+	}
+	tagStatus, ok := imageutil.StatusHasTag(is, tag)
+	if !ok || len(tagStatus.Items) == 0 {
+		return false, nil
+	}
+	return tagStatus.Items[0].Generation >= specGeneration, nil
+}
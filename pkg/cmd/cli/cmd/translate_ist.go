@@ -2,21 +2,31 @@ package cmd
 
 import (
 	"fmt"
-	"github.com/spf13/cobra"
+	"io"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
 
+	imagev1 "github.com/openshift/api/image/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
 
 	"github.com/gabemontero/obu/pkg/api"
 	"github.com/gabemontero/obu/pkg/util"
 
+	imageclientv1 "github.com/openshift/client-go/image/clientset/versioned/typed/image/v1"
 	"github.com/openshift/library-go/pkg/image/imageutil"
+	"github.com/openshift/library-go/pkg/image/reference"
 	imagehelpers "github.com/openshift/oc/pkg/helpers/image"
 )
 
 func NewCmdTranslateIST(cfg *api.Config) *cobra.Command {
 	translateCmd := &cobra.Command{
-		Use:   "translate <imagestreamtag> [<options>]",
+		Use:   "translate <imagestreamtag|imagestreamimage|dockerimage> [<options>]",
 		Short: "Translate an image stream tag",
 		Long:  "Translate an image stream reference to an image reference that can be pulled from an image registry.",
 		Example: `
@@ -25,82 +35,461 @@ $ obu translate mystream:latest
 
 # Translate an image stream tag that exists in another namespace
 $ obu translate nodejs:12 -n openshift
+
+# Translate an image stream image
+$ obu translate nodejs@sha256:3f2bd5a2e0b5dba86f1ad6e3c8d9a8ff0b1d3b31fb1a3ccdf4e8c4ea8ce3a25e -n openshift
+
+# Translate the 'from' of a BuildConfig strategy verbatim
+$ obu translate --from-reference "$(oc get bc/myapp -o jsonpath='{.spec.strategy.dockerStrategy.from}')"
+
+# Resolve an external image by tag to its digest
+$ obu translate quay.io/myorg/base:latest --kind DockerImage --sha-vs-tag
+
+# Explain how an image stream tag gets translated, including its reference policy and import status
+$ obu translate nodejs:12 -n openshift --explain
+
+# Import the latest image for an image stream tag, waiting up to a minute for the import, before translating it
+$ obu translate mystream:latest --import --import-timeout 1m
+
+# Keep printing the translated reference, and updating a Tekton result, every time the image stream tag changes
+$ obu translate mystream:latest --watch --output-file /tekton/results/image
+
+# List the mirrors, in the order they should be tried, for an image stream tag in a disconnected cluster
+$ obu translate nodejs:12 -n openshift --resolve-mirrors
+
+# Same as above, but only list the mirrors that actually respond for the image
+$ obu translate nodejs:12 -n openshift --resolve-mirrors --probe-mirrors
 `,
 		Run: func(cmd *cobra.Command, args []string) {
-			if len(args) == 0 {
+			if len(args) == 0 && len(cfg.FromReference) == 0 {
 				fmt.Fprintf(os.Stderr, "ERROR: not enough arguments: %s\n", cmd.Use)
 				return
 			}
-			istName := args[0]
-			stream, tag, ok := imageutil.SplitImageStreamTag(istName)
-			if !ok {
-				fmt.Fprint(os.Stderr, "ERROR: invalid image stream tag reference (use '<stream>:<tag>'): %s\n", istName)
+			ref, err := getTranslateReference(cfg, args)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
 				return
 			}
-			kubeconfig, err := util.GetConfig(cfg)
+			// only go to the registry for the digest of a DockerImage reference when explicitly asked to
+			cfg.ResolveDigest = cfg.SHA && cmd.Flags().Changed("sha-vs-tag")
+			clients, err := util.GetClients(cfg)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "ERROR: problem with kubeconfig: %v\n", err)
 				return
 			}
-			imageClient := util.GetImageClient(kubeconfig)
-			namespace := cfg.Namespace
-			if len(namespace) == 0 {
-				namespace = util.GetCurrentProject()
-				if len(namespace) == 0 {
+			if len(ref.Namespace) == 0 && ref.Kind != "DockerImage" {
+				ref.Namespace, err = util.GetNamespace(cfg)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
 					return
 				}
 			}
 
-			is, err := imageClient.ImageStreams(namespace).Get(stream, metav1.GetOptions{})
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "ERROR: problem retrieving image stream %s: %v\n", stream, err)
+			cfg.OutputFile = util.GetTektonOutputFile(cfg.OutputFile, util.TektonResultsDir)
+			if cfg.Watch {
+				if ref.Kind != "ImageStreamTag" {
+					fmt.Fprintf(os.Stderr, "ERROR: --watch only applies to ImageStreamTag references\n")
+					return
+				}
+				stream, tag, _ := imageutil.SplitImageStreamTag(ref.Name)
+				if err := watchImageStreamTag(cfg, clients, ref.Namespace, stream, tag); err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				}
 				return
 			}
-			// use source tag regardless
-			if cfg.OverrideLocal {
-				_, tagRef, _, err := imagehelpers.FollowTagReference(is, tag)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "ERROR: image stream tag %s had tag reference error: %v\n", istName, err)
+			if cfg.Explain {
+				if ref.Kind != "ImageStreamTag" {
+					fmt.Fprintf(os.Stderr, "ERROR: --explain only applies to ImageStreamTag references\n")
 					return
 				}
-				if tagRef == nil {
-					fmt.Fprintf(os.Stderr, "ERROR: image stream tag %s has no tag references\n", istName)
-				}
-
-				if !cfg.SHA {
-					fmt.Fprintf(os.Stdout, tagRef.From.Name)
+				stream, tag, _ := imageutil.SplitImageStreamTag(ref.Name)
+				is, err := getImageStreamForTag(cfg, clients.Image.ImageV1(), ref.Namespace, stream, tag)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
 					return
 				}
-				latestGen := int64(0)
-				latestGenImage := ""
-				for _, tagStatus := range is.Status.Tags {
-					if tagStatus.Tag == tag {
-						for _, item := range tagStatus.Items {
-							if item.Generation > latestGen {
-								latestGen = item.Generation
-								latestGenImage = item.DockerImageReference
-							}
-						}
-					}
+				if err := explainImageStreamTag(cfg, is, tag, os.Stdout); err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				}
+				return
+			}
+			img, err := translateObjectReference(cfg, clients, ref)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return
+			}
+			if !cfg.ResolveMirrors {
+				fmt.Fprintf(os.Stdout, "%s", img)
+				if err := writeTranslatedReference(cfg, img); err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
 				}
-				fmt.Fprintf(os.Stdout, latestGenImage)
 				return
 			}
-			// use local tag reference policy if available
-			img, ok := imageutil.ResolveLatestTaggedImage(is, tag)
-			if !ok {
-				fmt.Fprintf(os.Stderr, "ERROR: unable to resolve image stream tag %s\n", istName)
+
+			policies, err := clients.Operator.OperatorV1alpha1().ImageContentSourcePolicies().List(metav1.ListOptions{})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem listing image content source policies: %v\n", err)
 				return
 			}
-			fmt.Fprintf(os.Stdout, img)
+			pullSpecs, err := getImageMirrors(img, policies.Items)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem resolving mirrors for %s: %v\n", img, err)
+				return
+			}
+			resolved := []string{}
+			for _, pullSpec := range pullSpecs {
+				if cfg.ProbeMirrors {
+					status, err := util.ProbeImage(pullSpec)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "WARNING: problem probing %s: %v\n", pullSpec, err)
+					}
+					if status == util.ImageNotFound || status == util.ImageUnreachable {
+						fmt.Fprintf(os.Stderr, "WARNING: skipping %s as it is %s\n", pullSpec, status)
+						continue
+					}
+				}
+				fmt.Fprintf(os.Stdout, "%s\n", pullSpec)
+				resolved = append(resolved, pullSpec)
+			}
+			// the pull specs are written one per line, like they are printed
+			if err := writeTranslatedReference(cfg, strings.Join(resolved, "\n")); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			}
 		},
 	}
 	translateCmd.Flags().BoolVar(&(cfg.OverrideLocal), "override-local", cfg.OverrideLocal,
 		"Bypass local copy of image in OpenShift Internal registry and return external registry reference.")
 	translateCmd.Flags().BoolVar(&(cfg.SHA), "sha-vs-tag", true,
-		"End the translated image reference with the SHA instead of the tag name.")
-	translateCmd.Flags().StringVarP(&(cfg.Namespace), "namespace", "n", "",
-		"Specify the namespace the image stream is located in")
+		"End the translated image reference with the SHA instead of the tag name.  For DockerImage references the registry is only queried for the SHA when this is explicitly set.")
+	translateCmd.Flags().StringVar(&(cfg.Kind), "kind", cfg.Kind,
+		"The kind of reference being translated, one of ImageStreamTag, ImageStreamImage or DockerImage.  Inferred from the reference when not set.")
+	translateCmd.Flags().StringVar(&(cfg.FromReference), "from-reference", cfg.FromReference,
+		"A JSON or YAML object reference, with kind, name and optionally namespace, like those used by BuildConfigs, to translate instead of an argument.")
+	translateCmd.Flags().BoolVar(&(cfg.Explain), "explain", cfg.Explain,
+		"Report the tag reference chain, reference and lookup policies, import status and candidate references used to translate the image stream tag.")
+	translateCmd.Flags().BoolVar(&(cfg.Import), "import", cfg.Import,
+		"Import the image stream tag from its source, and wait for the import to complete, before translating it.")
+	translateCmd.Flags().StringVar(&(cfg.ImportFrom), "import-from", cfg.ImportFrom,
+		"With --import, the external image to import into the image stream tag, required if the tag does not exist yet.")
+	translateCmd.Flags().DurationVar(&(cfg.ImportTimeout), "import-timeout", 2*time.Minute,
+		"With --import, how long to wait for the image stream to reflect the import.")
+	translateCmd.Flags().BoolVar(&(cfg.Watch), "watch", cfg.Watch,
+		"Keep running, emitting the translated reference again every time the image the image stream tag points to changes.")
+	translateCmd.Flags().DurationVar(&(cfg.WatchResync), "watch-resync", 10*time.Minute,
+		"With --watch, how often the image stream is relisted in addition to the watch events.")
+	translateCmd.Flags().StringVar(&(cfg.OutputFile), "output-file", cfg.OutputFile,
+		"Also write the translated reference, or with --resolve-mirrors the pull specs one per line, to this file, replacing its contents on every change with --watch.  In a Tekton step, relative paths are under /tekton/results, so the file name can just be a Task result name.")
+	translateCmd.Flags().BoolVar(&(cfg.ResolveMirrors), "resolve-mirrors", cfg.ResolveMirrors,
+		"Apply the cluster's image content source policies to the translated reference and list, one per line, the pull specs to try in order.")
+	translateCmd.Flags().BoolVar(&(cfg.ProbeMirrors), "probe-mirrors", cfg.ProbeMirrors,
+		"With --resolve-mirrors, contact each registry and omit the pull specs it reports as not found or that cannot be reached.")
 
 	return translateCmd
 }
+
+// getTranslateReference builds the reference to translate from either the command line argument and --kind, or
+// the BuildConfig style object reference passed with --from-reference.
+func getTranslateReference(cfg *api.Config, args []string) (corev1.ObjectReference, error) {
+	ref := corev1.ObjectReference{}
+	switch {
+	case len(cfg.FromReference) > 0:
+		if err := yaml.Unmarshal([]byte(cfg.FromReference), &ref); err != nil {
+			return ref, fmt.Errorf("invalid object reference %q: %v", cfg.FromReference, err)
+		}
+	default:
+		ref.Kind = cfg.Kind
+		ref.Name = args[0]
+	}
+	return parseImageReference(ref)
+}
+
+// parseNamespacedImageReference parses an image stream tag, image stream image or docker image reference, allowing
+// image stream references in other namespaces in the <namespace>/<name> form 'oc' accepts; a first segment without
+// a '.' or ':' is not a registry host, so docker hub images need to be fully qualified.  Any other name with a '/'
+// is a docker image, as image stream names cannot contain one.
+func parseNamespacedImageReference(name, namespace string) (corev1.ObjectReference, error) {
+	ref := corev1.ObjectReference{Name: name, Namespace: namespace}
+	if parts := strings.SplitN(name, "/", 2); len(parts) == 2 {
+		ref.Kind = "DockerImage"
+		if !strings.ContainsAny(parts[0], ".:") && !strings.Contains(parts[1], "/") {
+			ref.Namespace, ref.Name = parts[0], parts[1]
+			ref.Kind = "ImageStreamTag"
+			if strings.Contains(ref.Name, "@") {
+				ref.Kind = "ImageStreamImage"
+			}
+		}
+	}
+	return parseImageReference(ref)
+}
+
+// parseImageReference validates an image object reference, inferring its kind from the name if it is not set.
+func parseImageReference(ref corev1.ObjectReference) (corev1.ObjectReference, error) {
+	if len(ref.Kind) == 0 {
+		// just like BuildConfigs, an untyped <stream>@<id> is clearly an image stream image
+		ref.Kind = "ImageStreamTag"
+		if strings.Contains(ref.Name, "@") {
+			ref.Kind = "ImageStreamImage"
+		}
+	}
+
+	switch ref.Kind {
+	case "ImageStreamTag":
+		if _, _, ok := imageutil.SplitImageStreamTag(ref.Name); !ok {
+			return ref, fmt.Errorf("invalid image stream tag reference (use '<stream>:<tag>'): %s", ref.Name)
+		}
+	case "ImageStreamImage":
+		if _, _, err := imageutil.ParseImageStreamImageName(ref.Name); err != nil {
+			return ref, fmt.Errorf("invalid image stream image reference (use '<stream>@<id>'): %s", ref.Name)
+		}
+	case "DockerImage":
+		if _, err := reference.Parse(ref.Name); err != nil {
+			return ref, fmt.Errorf("invalid docker image reference %s: %v", ref.Name, err)
+		}
+	default:
+		return ref, fmt.Errorf("unsupported reference kind %q (use ImageStreamTag, ImageStreamImage, or DockerImage)", ref.Kind)
+	}
+	return ref, nil
+}
+
+// translateObjectReference resolves any of the kinds of image references a BuildConfig can use into a pull spec.
+func translateObjectReference(cfg *api.Config, clients *util.Clients, ref corev1.ObjectReference) (string, error) {
+	imageClient := clients.Image.ImageV1()
+	switch ref.Kind {
+	case "ImageStreamTag":
+		stream, tag, _ := imageutil.SplitImageStreamTag(ref.Name)
+		is, err := getImageStreamForTag(cfg, imageClient, ref.Namespace, stream, tag)
+		if err != nil {
+			return "", err
+		}
+		return translateImageStreamTag(cfg, is, tag)
+	case "ImageStreamImage":
+		stream, id, err := imageutil.ParseImageStreamImageName(ref.Name)
+		if err != nil {
+			return "", err
+		}
+		is, err := imageClient.ImageStreams(ref.Namespace).Get(stream, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("problem retrieving image stream %s: %v", stream, err)
+		}
+		return translateImageStreamImage(cfg, is, id)
+	case "DockerImage":
+		if !cfg.ResolveDigest {
+			return ref.Name, nil
+		}
+		return util.ResolveDigest(ref.Name)
+	}
+	return "", fmt.Errorf("unsupported reference kind %q", ref.Kind)
+}
+
+// getImageStreamForTag retrieves the image stream for a tag, first importing the tag if requested.
+func getImageStreamForTag(cfg *api.Config, imageClient imageclientv1.ImageV1Interface, namespace, stream, tag string) (*imagev1.ImageStream, error) {
+	is, err := imageClient.ImageStreams(namespace).Get(stream, metav1.GetOptions{})
+	switch {
+	case err != nil && cfg.Import && kerrors.IsNotFound(err):
+		is = nil
+	case err != nil:
+		return nil, fmt.Errorf("problem retrieving image stream %s: %v", stream, err)
+	}
+	if cfg.Import {
+		return importImageStreamTag(cfg, imageClient, namespace, stream, tag, is)
+	}
+	return is, nil
+}
+
+// translateImageStreamImage finds the tag event for an image in the image stream, and applies the reference policy
+// of the tag it was found under.
+func translateImageStreamImage(cfg *api.Config, is *imagev1.ImageStream, id string) (string, error) {
+	for _, tagStatus := range is.Status.Tags {
+		for _, item := range tagStatus.Items {
+			if item.Image != id {
+				continue
+			}
+			if cfg.OverrideLocal {
+				return item.DockerImageReference, nil
+			}
+			tagRef, ok := imageutil.SpecHasTag(is, tagStatus.Tag)
+			if ok && tagRef.ReferencePolicy.Type == imagev1.LocalTagReferencePolicy && len(is.Status.DockerImageRepository) > 0 {
+				return is.Status.DockerImageRepository + "@" + item.Image, nil
+			}
+			return item.DockerImageReference, nil
+		}
+	}
+	return "", fmt.Errorf("image %s not found in image stream %s", id, is.Name)
+}
+
+func translateImageStreamTag(cfg *api.Config, is *imagev1.ImageStream, tag string) (string, error) {
+	istName := imageutil.JoinImageStreamTag(is.Name, tag)
+	// whichever way the reference is built, a tag that was never imported does not point at a usable image
+	if err := checkTagImported(is, tag); err != nil {
+		return "", err
+	}
+	// use source tag regardless
+	if cfg.OverrideLocal {
+		finalTag, tagRef, _, err := imagehelpers.FollowTagReference(is, tag)
+		if err != nil {
+			return "", fmt.Errorf("image stream tag %s had tag reference error: %v", istName, err)
+		}
+		if tagRef == nil {
+			return "", fmt.Errorf("image stream tag %s has no tag references", istName)
+		}
+
+		if !cfg.SHA {
+			return tagRef.From.Name, nil
+		}
+		// aliases without images of their own use those of the tag they point to
+		statusTag := tag
+		if tagStatus, _ := imageutil.StatusHasTag(is, tag); len(tagStatus.Items) == 0 {
+			statusTag = finalTag
+		}
+		latestGen := int64(0)
+		latestGenImage := ""
+		for _, tagStatus := range is.Status.Tags {
+			if tagStatus.Tag == statusTag {
+				for _, item := range tagStatus.Items {
+					if item.Generation > latestGen {
+						latestGen = item.Generation
+						latestGenImage = item.DockerImageReference
+					}
+				}
+			}
+		}
+		if len(latestGenImage) == 0 {
+			return "", fmt.Errorf("image stream tag %s has no images in its status", istName)
+		}
+		return latestGenImage, nil
+	}
+	// use local tag reference policy if available
+	img, ok := imageutil.ResolveLatestTaggedImage(is, tag)
+	if !ok {
+		return "", fmt.Errorf("unable to resolve image stream tag %s", istName)
+	}
+	return img, nil
+}
+
+// checkTagImported returns an error, including any import failure, for a tag that is in the image stream spec but
+// has no image in its status.
+func checkTagImported(is *imagev1.ImageStream, tag string) error {
+	if _, inSpec := imageutil.SpecHasTag(is, tag); !inSpec {
+		return nil
+	}
+	if tagStatus, inStatus := imageutil.StatusHasTag(is, tag); inStatus && len(tagStatus.Items) > 0 {
+		return nil
+	}
+	// an alias is imported as the tag it points to
+	importedTag := tag
+	if finalTag, _, _, err := imagehelpers.FollowTagReference(is, tag); err == nil {
+		importedTag = finalTag
+	}
+	if tagStatus, inStatus := imageutil.StatusHasTag(is, importedTag); inStatus && len(tagStatus.Items) > 0 {
+		return nil
+	}
+	istName := imageutil.JoinImageStreamTag(is.Name, tag)
+	for _, condition := range getTagConditions(is, importedTag) {
+		if condition.Type == imagev1.ImportSuccess && condition.Status == corev1.ConditionFalse {
+			return fmt.Errorf("image stream tag %s has never been imported, last import failed with %s: %s",
+				istName, condition.Reason, condition.Message)
+		}
+	}
+	return fmt.Errorf("image stream tag %s is in the image stream spec but has never been imported", istName)
+}
+
+func getTagConditions(is *imagev1.ImageStream, tag string) []imagev1.TagEventCondition {
+	tagStatus, _ := imageutil.StatusHasTag(is, tag)
+	return tagStatus.Conditions
+}
+
+// explainImageStreamTag reports each of the inputs that go into translating an image stream tag, followed by the
+// resulting reference.
+func explainImageStreamTag(cfg *api.Config, is *imagev1.ImageStream, tag string, out io.Writer) error {
+	fmt.Fprintf(out, "Image stream:\t\t%s/%s\n", is.Namespace, is.Name)
+	fmt.Fprintf(out, "Lookup policy local:\t%v\n", is.Spec.LookupPolicy.Local)
+	fmt.Fprintf(out, "Local repository:\t%s\n", is.Status.DockerImageRepository)
+
+	// walk any chain of tags that are aliases to other tags in the same stream; a tag of another stream ends the
+	// chain, as the image it points to is imported into this stream
+	chain := []string{tag}
+	seen := map[string]bool{tag: true}
+	lastLocalTag := tag
+	for current := tag; ; {
+		tagRef, inSpec := imageutil.SpecHasTag(is, current)
+		if !inSpec || tagRef.From == nil || tagRef.From.Kind != "ImageStreamTag" {
+			break
+		}
+		refStream, refTag := is.Name, tagRef.From.Name
+		if strings.Contains(refTag, ":") {
+			if stream, splitTag, ok := imageutil.SplitImageStreamTag(refTag); ok {
+				refStream, refTag = stream, splitTag
+			}
+		}
+		refNamespace := tagRef.From.Namespace
+		if len(refNamespace) == 0 {
+			refNamespace = is.Namespace
+		}
+		if refStream != is.Name || refNamespace != is.Namespace {
+			chain = append(chain, fmt.Sprintf("%s/%s (another image stream)", refNamespace, imageutil.JoinImageStreamTag(refStream, refTag)))
+			break
+		}
+		current = refTag
+		chain = append(chain, current)
+		// circular references are reported by FollowTagReference below
+		if seen[current] {
+			break
+		}
+		seen[current] = true
+		lastLocalTag = current
+	}
+	fmt.Fprintf(out, "Tag chain:\t\t%s\n", strings.Join(chain, " -> "))
+	finalTag, tagRef, multiple, err := imagehelpers.FollowTagReference(is, tag)
+	if err == imagehelpers.ErrCrossImageStreamReference {
+		finalTag, multiple, err = lastLocalTag, lastLocalTag != tag, nil
+		if spec, ok := imageutil.SpecHasTag(is, finalTag); ok {
+			tagRef = &spec
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("image stream tag %s had tag reference error: %v", imageutil.JoinImageStreamTag(is.Name, tag), err)
+	}
+	if multiple {
+		fmt.Fprintf(out, "Resolved tag:\t\t%s (via tag references)\n", finalTag)
+	}
+	if tagRef != nil {
+		if tagRef.From != nil {
+			fmt.Fprintf(out, "Spec from:\t\t%s %s\n", tagRef.From.Kind, tagRef.From.Name)
+		}
+		referencePolicy := tagRef.ReferencePolicy.Type
+		if len(referencePolicy) == 0 {
+			referencePolicy = imagev1.SourceTagReferencePolicy
+		}
+		fmt.Fprintf(out, "Reference policy:\t%s\n", referencePolicy)
+		fmt.Fprintf(out, "Scheduled import:\t%v\n", tagRef.ImportPolicy.Scheduled)
+	}
+
+	// imports, and so their conditions, happen for the tag the chain resolves to
+	conditions := getTagConditions(is, finalTag)
+	if len(conditions) > 0 {
+		fmt.Fprintf(out, "Import conditions:\n")
+		for _, condition := range conditions {
+			fmt.Fprintf(out, "\t%s=%s\t%s: %s (generation %d)\n", condition.Type, condition.Status,
+				condition.Reason, condition.Message, condition.Generation)
+		}
+	}
+
+	tagStatus, _ := imageutil.StatusHasTag(is, tag)
+	if len(tagStatus.Items) > 0 {
+		fmt.Fprintf(out, "Candidate references (newest first):\n")
+		for _, item := range tagStatus.Items {
+			fmt.Fprintf(out, "\t%s\t(generation %d, created %s)\n", item.DockerImageReference, item.Generation,
+				item.Created.UTC().Format(time.RFC3339))
+			if len(is.Status.DockerImageRepository) > 0 && len(item.Image) > 0 {
+				fmt.Fprintf(out, "\t%s@%s\t(local pull through)\n", is.Status.DockerImageRepository, item.Image)
+			}
+		}
+	}
+
+	img, err := translateImageStreamTag(cfg, is, tag)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Translated reference:\t%s\n", img)
+	return nil
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+	imagev1 "github.com/openshift/api/image/v1"
+	imageinformers "github.com/openshift/client-go/image/informers/externalversions"
+	"github.com/openshift/library-go/pkg/image/imageutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchImageStreamTag re-emits the translated reference for an image stream tag every time the image it resolves
+// to changes, until obu is told to stop.  This is the local equivalent of a BuildConfig ImageChange trigger.
+func watchImageStreamTag(cfg *api.Config, clients *util.Clients, namespace, stream, tag string) error {
+	factory := imageinformers.NewSharedInformerFactoryWithOptions(clients.Image, cfg.WatchResync,
+		imageinformers.WithNamespace(namespace),
+		imageinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", stream).String()
+		}))
+	informer := factory.Image().V1().ImageStreams().Informer()
+
+	updates := make(chan *imagev1.ImageStream, 10)
+	enqueue := func(obj interface{}) {
+		if is, ok := obj.(*imagev1.ImageStream); ok && is.Name == stream {
+			updates <- is
+		}
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(old, new interface{}) { enqueue(new) },
+	})
+
+	stop := util.SetupSignalHandler()
+	factory.Start(stop)
+	istName := imageutil.JoinImageStreamTag(stream, tag)
+	last := ""
+	for {
+		select {
+		case <-stop:
+			return nil
+		case is := <-updates:
+			img, err := translateImageStreamTag(cfg, is, tag)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: image stream tag %s cannot be translated yet: %v\n", istName, err)
+				continue
+			}
+			if img == last {
+				continue
+			}
+			last = img
+			if err := emitTranslatedReference(cfg, img); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// emitTranslatedReference prints the reference on its own line, as every change is emitted with --watch, and
+// writes it to the output file when one has been specified.
+func emitTranslatedReference(cfg *api.Config, img string) error {
+	fmt.Fprintf(os.Stdout, "%s\n", img)
+	return writeTranslatedReference(cfg, img)
+}
+
+// writeTranslatedReference replaces the contents of the output file, such as a Tekton result, with the reference
+// when one has been specified.
+func writeTranslatedReference(cfg *api.Config, img string) error {
+	if len(cfg.OutputFile) == 0 {
+		return nil
+	}
+	if err := ioutil.WriteFile(cfg.OutputFile, []byte(img), 0644); err != nil {
+		return fmt.Errorf("problem writing translated reference to %s: %v", cfg.OutputFile, err)
+	}
+	return nil
+}
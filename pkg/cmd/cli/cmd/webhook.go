@@ -0,0 +1,265 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+	"github.com/spf13/cobra"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// tektonTaskRunLabel is set by Tekton on the pods of every TaskRun
+	tektonTaskRunLabel = "tekton.dev/taskRun"
+
+	buildConfigVolumeName = "obu-build-config"
+	buildAuthVolumeName   = "obu-build-auth"
+	buildConfigMountPath  = "/var/run/obu/build-config"
+	buildAuthMountPath    = "/var/run/obu/build-auth"
+	registriesConfPath    = "/etc/containers/registries.conf"
+)
+
+func NewCmdWebhook(cfg *api.Config) *cobra.Command {
+	webhookCmd := &cobra.Command{
+		Use:   "webhook [<options>]",
+		Short: "Inject the build configuration into TaskRun pods.",
+		Long: "Run a mutating admission webhook that injects the cluster's proxy settings, a CA bundle with the proxy,\n" +
+			"internal registry and mirror registry CAs, the mirrors registries.conf and the registry credentials of the\n" +
+			"pod's service account into the pods of labeled TaskRuns, so that their Tasks do not need obu steps.",
+		Example: `
+# Serve the webhook with the certificate the service CA operator generated for its service, injecting into the
+# pods of TaskRuns labeled with 'obu.gabemontero.github.io/inject-build-config=true'
+$ obu webhook --tls-cert-file /var/run/secrets/serving-cert/tls.crt --tls-key-file /var/run/secrets/serving-cert/tls.key
+
+# Register it for the pods of those TaskRuns
+$ oc apply -f - <<EOF
+apiVersion: admissionregistration.k8s.io/v1beta1
+kind: MutatingWebhookConfiguration
+metadata:
+  name: obu
+  annotations:
+    service.beta.openshift.io/inject-cabundle: "true"
+webhooks:
+- name: build-config.obu.gabemontero.github.io
+  clientConfig:
+    service: {namespace: obu, name: obu-webhook, path: /mutate}
+  rules:
+  - {operations: [CREATE], apiGroups: [""], apiVersions: [v1], resources: [pods]}
+  objectSelector:
+    matchLabels: {obu.gabemontero.github.io/inject-build-config: "true"}
+  failurePolicy: Ignore
+  sideEffects: NoneOnDryRun
+EOF
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			selector, err := labels.Parse(cfg.WebhookSelector)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: invalid pod selector %q: %v\n", cfg.WebhookSelector, err)
+				return
+			}
+			clients, err := util.GetClients(cfg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: problem with kubeconfig: %v\n", err)
+				return
+			}
+			mux := http.NewServeMux()
+			mux.Handle("/mutate", newBuildConfigWebhook(cfg, clients, selector))
+			mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			server := &http.Server{Addr: ":" + strconv.Itoa(cfg.WebhookPort), Handler: mux}
+
+			ctx := util.SignalContext()
+			go func() {
+				<-ctx.Done()
+				server.Shutdown(context.Background())
+			}()
+			err = server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+			if err != nil && err != http.ErrServerClosed {
+				fmt.Fprintf(os.Stderr, "ERROR: problem serving the webhook: %v\n", err)
+			}
+		},
+	}
+	webhookCmd.Flags().IntVar(&(cfg.WebhookPort), "port", 8443,
+		"The port to serve the webhook on.")
+	webhookCmd.Flags().StringVar(&(cfg.TLSCertFile), "tls-cert-file", "/var/run/secrets/serving-cert/tls.crt",
+		"The serving certificate of the webhook.")
+	webhookCmd.Flags().StringVar(&(cfg.TLSKeyFile), "tls-key-file", "/var/run/secrets/serving-cert/tls.key",
+		"The private key of the serving certificate.")
+	webhookCmd.Flags().StringVar(&(cfg.WebhookSelector), "selector", "obu.gabemontero.github.io/inject-build-config=true",
+		"Only inject into TaskRun pods with labels matching this selector.")
+	return webhookCmd
+}
+
+// buildConfigWebhook is the admission handler, separate from the server so that it can be exercised with any
+// http server and with fake clients.
+type buildConfigWebhook struct {
+	cfg      *api.Config
+	clients  *util.Clients
+	selector labels.Selector
+}
+
+func newBuildConfigWebhook(cfg *api.Config, clients *util.Clients, selector labels.Selector) http.Handler {
+	return &buildConfigWebhook{cfg: cfg, clients: clients, selector: selector}
+}
+
+func (wh *buildConfigWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review := &admissionv1beta1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("invalid admission review: %v", err), http.StatusBadRequest)
+		return
+	}
+	review.Response = wh.admit(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+	data, err := json.Marshal(review)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// admit never rejects a pod, problems are reported in the response and leave the pod as is, as a build without the
+// injected configuration may well still work
+func (wh *buildConfigWebhook) admit(req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	allowed := &admissionv1beta1.AdmissionResponse{Allowed: true}
+	if req.Resource.Resource != "pods" || req.Operation != admissionv1beta1.Create {
+		return allowed
+	}
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, pod); err != nil {
+		allowed.Result = &metav1.Status{Message: fmt.Sprintf("problem decoding pod: %v", err)}
+		return allowed
+	}
+	if _, ok := pod.Labels[tektonTaskRunLabel]; !ok || !wh.selector.Matches(labels.Set(pod.Labels)) {
+		return allowed
+	}
+
+	// the credentials are those of the service account the pod runs as, in its namespace
+	cfg := *wh.cfg
+	cfg.ServiceAccount = pod.Spec.ServiceAccountName
+	if len(cfg.ServiceAccount) == 0 {
+		cfg.ServiceAccount = "default"
+	}
+	data, err := getBuildConfigData(&cfg, wh.clients, req.Namespace)
+	// a dry run admission must not have side effects, so only the patch is computed
+	if err == nil && (req.DryRun == nil || !*req.DryRun) {
+		_, err = applyBuildConfig(wh.clients, newBuildConfigMap(req.Namespace, cfg.ServiceAccount, data), newBuildAuthSecret(req.Namespace, cfg.ServiceAccount, data))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: not injecting build configuration into pod %s/%s: %v\n", req.Namespace, pod.GenerateName, err)
+		allowed.Result = &metav1.Status{Message: err.Error()}
+		return allowed
+	}
+
+	patch, err := json.Marshal(getBuildConfigPodPatch(pod, cfg.ServiceAccount, data))
+	if err != nil {
+		allowed.Result = &metav1.Status{Message: err.Error()}
+		return allowed
+	}
+	patchType := admissionv1beta1.PatchTypeJSONPatch
+	allowed.Patch = patch
+	allowed.PatchType = &patchType
+	return allowed
+}
+
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// getBuildConfigPodPatch adds the build configuration volumes of the pod's service account to the pod, and mounts
+// them, along with the proxy environment variables, in each of its containers.  Settings a container already has are
+// left alone.
+func getBuildConfigPodPatch(pod *corev1.Pod, serviceAccount string, data *buildConfigData) []jsonPatchOperation {
+	volumes := append([]corev1.Volume{}, pod.Spec.Volumes...)
+	volumes = append(volumes, corev1.Volume{
+		Name: buildConfigVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: getBuildConfigMapName(serviceAccount)}},
+		},
+	})
+	mounts := []corev1.VolumeMount{{Name: buildConfigVolumeName, MountPath: buildConfigMountPath, ReadOnly: true}}
+	// an empty registries.conf would hide the one of the image rather than add to it
+	if len(data.RegistriesConf) > 0 {
+		mounts = append(mounts, corev1.VolumeMount{Name: buildConfigVolumeName, MountPath: registriesConfPath, SubPath: buildConfigRegistriesConfKey, ReadOnly: true})
+	}
+	env := []corev1.EnvVar{}
+	for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy"} {
+		if value, ok := data.ProxyEnv[name]; ok {
+			env = append(env, corev1.EnvVar{Name: name, Value: value})
+		}
+	}
+	if data.DockerConfigJSON != nil {
+		volumes = append(volumes, corev1.Volume{
+			Name: buildAuthVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: getBuildAuthSecretName(serviceAccount),
+					Items:      []corev1.KeyToPath{{Key: corev1.DockerConfigJsonKey, Path: "config.json"}},
+				},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: buildAuthVolumeName, MountPath: buildAuthMountPath, ReadOnly: true})
+		// containers/image based tools read REGISTRY_AUTH_FILE, docker based ones $DOCKER_CONFIG/config.json
+		env = append(env,
+			corev1.EnvVar{Name: "REGISTRY_AUTH_FILE", Value: path.Join(buildAuthMountPath, "config.json")},
+			corev1.EnvVar{Name: "DOCKER_CONFIG", Value: buildAuthMountPath})
+	}
+
+	patch := []jsonPatchOperation{{Op: "add", Path: "/spec/volumes", Value: volumes}}
+	for i := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[i]
+		patch = append(patch,
+			jsonPatchOperation{Op: "add", Path: fmt.Sprintf("/spec/containers/%d/env", i), Value: mergeEnv(container.Env, env)},
+			jsonPatchOperation{Op: "add", Path: fmt.Sprintf("/spec/containers/%d/volumeMounts", i), Value: mergeVolumeMounts(container.VolumeMounts, mounts)})
+	}
+	return patch
+}
+
+func mergeEnv(existing, added []corev1.EnvVar) []corev1.EnvVar {
+	merged := append([]corev1.EnvVar{}, existing...)
+	names := map[string]bool{}
+	for _, env := range existing {
+		names[env.Name] = true
+	}
+	for _, env := range added {
+		if !names[env.Name] {
+			merged = append(merged, env)
+		}
+	}
+	return merged
+}
+
+func mergeVolumeMounts(existing, added []corev1.VolumeMount) []corev1.VolumeMount {
+	merged := append([]corev1.VolumeMount{}, existing...)
+	paths := map[string]bool{}
+	for _, mount := range existing {
+		paths[mount.MountPath] = true
+	}
+	for _, mount := range added {
+		if !paths[mount.MountPath] {
+			merged = append(merged, mount)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,294 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/gabemontero/obu/pkg/api"
+	"github.com/gabemontero/obu/pkg/util"
+	configv1 "github.com/openshift/api/config/v1"
+	operatorv1alpha1 "github.com/openshift/api/operator/v1alpha1"
+	configfake "github.com/openshift/client-go/config/clientset/versioned/fake"
+	imagefake "github.com/openshift/client-go/image/clientset/versioned/fake"
+	operatorfake "github.com/openshift/client-go/operator/clientset/versioned/fake"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+const testRegistryHost = "image-registry.openshift-image-registry.svc:5000"
+
+func newTestWebhookClients(objs ...runtime.Object) (*util.Clients, *kubefake.Clientset) {
+	coreClient := kubefake.NewSimpleClientset(
+		&corev1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Name: "pipeline", Namespace: "demo"},
+			Secrets:          []corev1.ObjectReference{{Name: "pipeline-dockercfg"}},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "deleted-pull-secret"}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "pipeline-dockercfg", Namespace: "demo"},
+			Type:       corev1.SecretTypeDockercfg,
+			Data: map[string][]byte{
+				corev1.DockerConfigKey: []byte(`{"` + testRegistryHost + `":{"username":"serviceaccount","password":"token"}}`),
+			},
+		})
+	return &util.Clients{
+		Core: coreClient,
+		Config: configfake.NewSimpleClientset(
+			&configv1.Proxy{
+				ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+				Status:     configv1.ProxyStatus{HTTPProxy: "http://proxy:3128", NoProxy: ".cluster.local"},
+			},
+			&configv1.Image{
+				ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+				Status:     configv1.ImageStatus{InternalRegistryHostname: testRegistryHost},
+			}),
+		Image:    imagefake.NewSimpleClientset(),
+		Operator: operatorfake.NewSimpleClientset(objs...),
+	}, coreClient
+}
+
+func newTestTaskRunPod(t *testing.T, serviceAccount string) []byte {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "build-pod-",
+			Namespace:    "demo",
+			Labels:       map[string]string{tektonTaskRunLabel: "build", "obu.gabemontero.github.io/inject-build-config": "true"},
+		},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: serviceAccount,
+			Containers: []corev1.Container{{
+				Name:  "step-build",
+				Image: "quay.io/buildah/stable",
+				Env:   []corev1.EnvVar{{Name: "HTTP_PROXY", Value: "http://other:8080"}},
+			}},
+		},
+	}
+	data, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("unexpected error encoding pod: %v", err)
+	}
+	return data
+}
+
+func newTestWebhook(clients *util.Clients) *buildConfigWebhook {
+	selector := labels.SelectorFromSet(labels.Set{"obu.gabemontero.github.io/inject-build-config": "true"})
+	return newBuildConfigWebhook(&api.Config{}, clients, selector).(*buildConfigWebhook)
+}
+
+func applyTestPodPatch(t *testing.T, podData []byte, response *admissionv1beta1.AdmissionResponse) *corev1.Pod {
+	if !response.Allowed || response.PatchType == nil || *response.PatchType != admissionv1beta1.PatchTypeJSONPatch {
+		t.Fatalf("expected an allowed response with a JSON patch, got %#v", response)
+	}
+	patch, err := jsonpatch.DecodePatch(response.Patch)
+	if err != nil {
+		t.Fatalf("invalid JSON patch %s: %v", response.Patch, err)
+	}
+	patched, err := patch.Apply(podData)
+	if err != nil {
+		t.Fatalf("problem applying JSON patch %s: %v", response.Patch, err)
+	}
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(patched, pod); err != nil {
+		t.Fatalf("unexpected error decoding the patched pod: %v", err)
+	}
+	return pod
+}
+
+func getTestEnvValue(env []corev1.EnvVar, name string) string {
+	for _, e := range env {
+		if e.Name == name {
+			return e.Value
+		}
+	}
+	return ""
+}
+
+func TestBuildConfigWebhookServesPatch(t *testing.T) {
+	clients, coreClient := newTestWebhookClients(&operatorv1alpha1.ImageContentSourcePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "mirrors"},
+		Spec: operatorv1alpha1.ImageContentSourcePolicySpec{
+			RepositoryDigestMirrors: []operatorv1alpha1.RepositoryDigestMirrors{
+				{Source: "quay.io/foo", Mirrors: []string{"mirror.local:5000/foo"}},
+			},
+		},
+	})
+	server := httptest.NewTLSServer(newTestWebhook(clients))
+	defer server.Close()
+
+	podData := newTestTaskRunPod(t, "pipeline")
+	review, err := json.Marshal(&admissionv1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: admissionv1beta1.SchemeGroupVersion.String(), Kind: "AdmissionReview"},
+		Request: &admissionv1beta1.AdmissionRequest{
+			UID:       types.UID("1234"),
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Namespace: "demo",
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: podData},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error encoding admission review: %v", err)
+	}
+	resp, err := server.Client().Post(server.URL+"/mutate", "application/json", bytes.NewReader(review))
+	if err != nil {
+		t.Fatalf("unexpected error calling the webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	result := &admissionv1beta1.AdmissionReview{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatalf("unexpected error decoding the webhook response: %v", err)
+	}
+	if result.Response == nil || result.Response.UID != "1234" {
+		t.Fatalf("expected a response for request 1234, got %#v", result.Response)
+	}
+
+	pod := applyTestPodPatch(t, podData, result.Response)
+	volumes := map[string]bool{}
+	for _, volume := range pod.Spec.Volumes {
+		volumes[volume.Name] = true
+	}
+	if !volumes[buildConfigVolumeName] || !volumes[buildAuthVolumeName] {
+		t.Errorf("expected the build config and auth volumes, got %v", pod.Spec.Volumes)
+	}
+	container := pod.Spec.Containers[0]
+	if value := getTestEnvValue(container.Env, "HTTP_PROXY"); value != "http://other:8080" {
+		t.Errorf("expected the container's own HTTP_PROXY to be kept, got %q", value)
+	}
+	if value := getTestEnvValue(container.Env, "no_proxy"); value != ".cluster.local" {
+		t.Errorf("expected no_proxy to be injected, got %q", value)
+	}
+	if value := getTestEnvValue(container.Env, "REGISTRY_AUTH_FILE"); value != buildAuthMountPath+"/config.json" {
+		t.Errorf("expected REGISTRY_AUTH_FILE to be injected, got %q", value)
+	}
+	mounts := map[string]string{}
+	for _, mount := range container.VolumeMounts {
+		mounts[mount.MountPath] = mount.SubPath
+	}
+	if subPath, ok := mounts[registriesConfPath]; !ok || subPath != buildConfigRegistriesConfKey {
+		t.Errorf("expected registries.conf to be mounted, got %v", container.VolumeMounts)
+	}
+	if _, ok := mounts[buildAuthMountPath]; !ok {
+		t.Errorf("expected the registry credentials to be mounted, got %v", container.VolumeMounts)
+	}
+
+	cm, err := coreClient.CoreV1().ConfigMaps("demo").Get(getBuildConfigMapName("pipeline"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the build config map to be created: %v", err)
+	}
+	if len(cm.Data[buildConfigRegistriesConfKey]) == 0 || cm.Data["HTTP_PROXY"] != "http://proxy:3128" {
+		t.Errorf("unexpected build config map data %v", cm.Data)
+	}
+	if _, err := coreClient.CoreV1().Secrets("demo").Get(getBuildAuthSecretName("pipeline"), metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the build auth secret to be created: %v", err)
+	}
+}
+
+func TestBuildConfigWebhookDryRun(t *testing.T) {
+	clients, coreClient := newTestWebhookClients()
+	dryRun := true
+	podData := newTestTaskRunPod(t, "pipeline")
+	response := newTestWebhook(clients).admit(&admissionv1beta1.AdmissionRequest{
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Namespace: "demo",
+		Operation: admissionv1beta1.Create,
+		Object:    runtime.RawExtension{Raw: podData},
+		DryRun:    &dryRun,
+	})
+
+	pod := applyTestPodPatch(t, podData, response)
+	for _, mount := range pod.Spec.Containers[0].VolumeMounts {
+		if mount.MountPath == registriesConfPath {
+			t.Errorf("expected no registries.conf mount without mirror or registry settings, got %v", mount)
+		}
+	}
+	for _, action := range coreClient.Actions() {
+		if action.GetVerb() == "create" || action.GetVerb() == "update" {
+			t.Errorf("expected no writes for a dry run, got %v", action)
+		}
+	}
+}
+
+func TestBuildConfigWebhookIgnoresOtherPods(t *testing.T) {
+	clients, coreClient := newTestWebhookClients()
+	pod, err := json.Marshal(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "demo"}})
+	if err != nil {
+		t.Fatalf("unexpected error encoding pod: %v", err)
+	}
+	response := newTestWebhook(clients).admit(&admissionv1beta1.AdmissionRequest{
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Namespace: "demo",
+		Operation: admissionv1beta1.Create,
+		Object:    runtime.RawExtension{Raw: pod},
+	})
+	if !response.Allowed || response.Patch != nil {
+		t.Errorf("expected the pod to be allowed as is, got %#v", response)
+	}
+	if len(coreClient.Actions()) != 0 {
+		t.Errorf("expected no API calls, got %v", coreClient.Actions())
+	}
+}
+
+func TestBuildConfigWebhookSeparatesServiceAccounts(t *testing.T) {
+	clients, coreClient := newTestWebhookClients()
+	if _, err := coreClient.CoreV1().ServiceAccounts("demo").Create(&corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "builder", Namespace: "demo"},
+		Secrets:    []corev1.ObjectReference{{Name: "builder-dockercfg"}},
+	}); err != nil {
+		t.Fatalf("unexpected error creating service account: %v", err)
+	}
+	if _, err := coreClient.CoreV1().Secrets("demo").Create(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "builder-dockercfg", Namespace: "demo"},
+		Type:       corev1.SecretTypeDockercfg,
+		Data: map[string][]byte{
+			corev1.DockerConfigKey: []byte(`{"` + testRegistryHost + `":{"username":"serviceaccount","password":"builder-token"}}`),
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error creating secret: %v", err)
+	}
+
+	wh := newTestWebhook(clients)
+	for _, serviceAccount := range []string{"pipeline", "builder"} {
+		podData := newTestTaskRunPod(t, serviceAccount)
+		response := wh.admit(&admissionv1beta1.AdmissionRequest{
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Namespace: "demo",
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: podData},
+		})
+		pod := applyTestPodPatch(t, podData, response)
+		secretNames := map[string]string{}
+		for _, volume := range pod.Spec.Volumes {
+			switch {
+			case volume.Secret != nil:
+				secretNames[volume.Name] = volume.Secret.SecretName
+			case volume.ConfigMap != nil:
+				secretNames[volume.Name] = volume.ConfigMap.Name
+			}
+		}
+		if secretNames[buildAuthVolumeName] != getBuildAuthSecretName(serviceAccount) || secretNames[buildConfigVolumeName] != getBuildConfigMapName(serviceAccount) {
+			t.Errorf("expected the pod of %s to mount its own build config and auth, got %v", serviceAccount, secretNames)
+		}
+	}
+
+	for serviceAccount, token := range map[string]string{"pipeline": `"token"`, "builder": `"builder-token"`} {
+		secret, err := coreClient.CoreV1().Secrets("demo").Get(getBuildAuthSecretName(serviceAccount), metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("expected the build auth secret of %s to be created: %v", serviceAccount, err)
+		}
+		if !bytes.Contains(secret.Data[corev1.DockerConfigJsonKey], []byte(token)) {
+			t.Errorf("expected the build auth secret of %s to hold its own credentials, got %s", serviceAccount, secret.Data[corev1.DockerConfigJsonKey])
+		}
+	}
+}
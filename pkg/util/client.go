@@ -2,84 +2,108 @@ package util
 
 import (
 	"fmt"
-	"os"
-	"os/user"
-	"path/filepath"
+	"net/http"
 
 	"github.com/gabemontero/obu/pkg/api"
+	buildset "github.com/openshift/client-go/build/clientset/versioned"
 	configset "github.com/openshift/client-go/config/clientset/versioned"
-	configv1 "github.com/openshift/client-go/config/clientset/versioned/typed/config/v1"
 	imageset "github.com/openshift/client-go/image/clientset/versioned"
-	imagev1 "github.com/openshift/client-go/image/clientset/versioned/typed/image/v1"
 	operatorset "github.com/openshift/client-go/operator/clientset/versioned"
-	operatorv1alpha1 "github.com/openshift/client-go/operator/clientset/versioned/typed/operator/v1alpha1"
 
-
-	"k8s.io/client-go/rest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	kubeset "k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/cli-runtime/pkg/genericclioptions"
-	kcmdutil "k8s.io/kubectl/pkg/cmd/util"
-
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
 )
 
-func GetConfig(cfg *api.Config) (*rest.Config, error) {
-	if len(cfg.Kubeconfig) > 0 {
-		return clientcmd.BuildConfigFromFlags("", cfg.Kubeconfig)
-	}
-	// If an env variable is specified with the config locaiton, use that
-	if len(os.Getenv("KUBECONFIG")) > 0 {
-		return clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
-	}
-	// If no explicit location, try the in-cluster config
-	if c, err := rest.InClusterConfig(); err == nil {
-		return c, nil
-	}
-	// If no in-cluster config, try the default location in the user's home directory
-	if usr, err := user.Current(); err == nil {
-		if c, err := clientcmd.BuildConfigFromFlags(
-			"", filepath.Join(usr.HomeDir, ".kube", "config")); err == nil {
-			return c, nil
-		}
-	}
-
-	return nil, fmt.Errorf("could not locate a kubeconfig")
-}
-
-func GetImageClient(cfg *rest.Config) imagev1.ImageV1Interface {
-	return imageset.NewForConfigOrDie(cfg).ImageV1()
-}
-
-func GetProxyClient(cfg *rest.Config) configv1.ProxyInterface {
-	return configset.NewForConfigOrDie(cfg).ConfigV1().Proxies()
-}
+// Clients bundles the API clients used by the obu commands.  They are either backed by a live cluster, or when
+// running in offline mode, by in memory object trackers seeded from local manifests.
+type Clients struct {
+	// RestConfig is nil when running in offline mode
+	RestConfig *rest.Config
 
-func GetImageMirrorClient(cfg *rest.Config) operatorv1alpha1.ImageContentSourcePolicyInterface {
-	return operatorset.NewForConfigOrDie(cfg).OperatorV1alpha1().ImageContentSourcePolicies()
+	Core     kubeset.Interface
+	Build    buildset.Interface
+	Config   configset.Interface
+	Image    imageset.Interface
+	Operator operatorset.Interface
+	Dynamic  dynamic.Interface
 }
 
-func GetImageConfigClient(cfg *rest.Config) configv1.ImageInterface {
-	return configset.NewForConfigOrDie(cfg).ConfigV1().Images()
+// GetConfig returns the rest config for the cluster selected by the standard kubeconfig flags (--kubeconfig,
+// --context, --server, --token, etc.), falling back to the in-cluster config when running in a pod.
+// Requests are retried on transient errors, bounded by --request-timeout, and aborted when obu is asked to terminate.
+func GetConfig(cfg *api.Config) (*rest.Config, error) {
+	kubeconfig, err := cfg.ConfigFlags.ToRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+	// the timeout is applied per attempt by the retrying round tripper, which unlike the http client's timeout,
+	// can leave watches alone
+	timeout := kubeconfig.Timeout
+	kubeconfig.Timeout = 0
+	kubeconfig.WrapTransport = transport.Wrappers(kubeconfig.WrapTransport, func(rt http.RoundTripper) http.RoundTripper {
+		return newRetryingRoundTripper(rt, timeout)
+	})
+	return kubeconfig, nil
 }
 
-func GetCoreClient(cfg *rest.Config) *kubeset.Clientset {
-	return kubeset.NewForConfigOrDie(cfg)
+// GetClients returns the clients for either the cluster pointed to by the kubeconfig, or the local manifests
+// when offline mode has been requested.
+func GetClients(cfg *api.Config) (*Clients, error) {
+	if IsOffline(cfg) {
+		return GetOfflineClients(cfg)
+	}
+	kubeconfig, err := GetConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	clients := &Clients{RestConfig: kubeconfig}
+	if clients.Core, err = kubeset.NewForConfig(kubeconfig); err != nil {
+		return nil, err
+	}
+	if clients.Build, err = buildset.NewForConfig(kubeconfig); err != nil {
+		return nil, err
+	}
+	if clients.Config, err = configset.NewForConfig(kubeconfig); err != nil {
+		return nil, err
+	}
+	if clients.Image, err = imageset.NewForConfig(kubeconfig); err != nil {
+		return nil, err
+	}
+	if clients.Operator, err = operatorset.NewForConfig(kubeconfig); err != nil {
+		return nil, err
+	}
+	if clients.Dynamic, err = dynamic.NewForConfig(kubeconfig); err != nil {
+		return nil, err
+	}
+	return clients, nil
 }
 
-func GetCurrentProject() string {
-	kubeConfigFlags := genericclioptions.NewConfigFlags(true)
-	matchVersionKubeConfigFlags := kcmdutil.NewMatchVersionFlags(kubeConfigFlags)
-	f := kcmdutil.NewFactory(matchVersionKubeConfigFlags)
-	cfg, err := f.ToRawKubeConfigLoader().RawConfig()
+// GetNamespace returns the namespace from -n, or else from the same kubeconfig context the rest config is built
+// from, or when neither picks one, like inside a Tekton step, the namespace of the pod obu is running in.
+func GetNamespace(cfg *api.Config) (string, error) {
+	loader := cfg.ConfigFlags.ToRawKubeConfigLoader()
+	namespace, overridden, err := loader.Namespace()
 	if err != nil {
-		fmt.Fprintf(os.Stderr,"ERROR: could not get default project: %v", err)
-		return ""
+		return "", fmt.Errorf("could not determine the namespace: %v", err)
+	}
+	if overridden || namespace != metav1.NamespaceDefault {
+		return namespace, nil
 	}
-	currentProject := ""
-	currentContext := cfg.Contexts[cfg.CurrentContext]
-	if currentContext != nil {
-		currentProject = currentContext.Namespace
+	// only an implicit "default" namespace is replaced, not one the kubeconfig context explicitly sets
+	if raw, err := loader.RawConfig(); err == nil {
+		currentContext := raw.CurrentContext
+		if cfg.ConfigFlags.Context != nil && len(*cfg.ConfigFlags.Context) > 0 {
+			currentContext = *cfg.ConfigFlags.Context
+		}
+		if context := raw.Contexts[currentContext]; context != nil && len(context.Namespace) > 0 {
+			return namespace, nil
+		}
 	}
-	return currentProject
+	if podNamespace := GetPodNamespace(); len(podNamespace) > 0 {
+		return podNamespace, nil
+	}
+	return namespace, nil
 }
-
@@ -0,0 +1,172 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/openshift/library-go/pkg/image/reference"
+)
+
+// RegistryAuth is the credentials for a registry, as found in a docker config file.
+type RegistryAuth struct {
+	Username string
+	Password string
+}
+
+// ImageConfig is the part of an image's configuration that says how containers run from it.
+type ImageConfig struct {
+	User       string            `json:"User,omitempty"`
+	Env        []string          `json:"Env,omitempty"`
+	Labels     map[string]string `json:"Labels,omitempty"`
+	WorkingDir string            `json:"WorkingDir,omitempty"`
+}
+
+// imageManifest covers both image manifests and manifest lists, in the docker and OCI forms
+type imageManifest struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType"`
+	Config        struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// registrySession makes registry API requests for a single repository, authenticating as the registry asks to.
+type registrySession struct {
+	client *http.Client
+	auth   *RegistryAuth
+	token  string
+}
+
+// GetImageConfig retrieves the configuration of an image from its registry, using the credentials when the registry
+// asks for them, and trusting caData in addition to the system CAs.  Like containers/image does for registries
+// marked insecure, their certificates are not verified and plain HTTP is used when they do not serve HTTPS.  For
+// manifest lists, the image for the platform obu runs on is used.
+func GetImageConfig(ref string, auth *RegistryAuth, caData string, insecure bool) (*ImageConfig, error) {
+	parsed, err := reference.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	parsed = parsed.DockerClientDefaults().AsV2()
+	session := &registrySession{client: registryClient, auth: auth}
+	if len(caData) > 0 || insecure {
+		session.client = newRegistryClient(caData, insecure)
+	}
+	scheme := "https"
+	if insecure {
+		if resp, err := session.client.Get("https://" + parsed.Registry + "/v2/"); err == nil {
+			resp.Body.Close()
+		} else {
+			scheme = "http"
+		}
+	}
+	repositoryURL := fmt.Sprintf("%s://%s/v2/%s", scheme, parsed.Registry, parsed.RepositoryName())
+
+	manifestRef := parsed.ID
+	if len(manifestRef) == 0 {
+		manifestRef = parsed.Tag
+	}
+	manifest := &imageManifest{}
+	if err := session.getJSON(repositoryURL+"/manifests/"+manifestRef, manifestMediaTypes, manifest); err != nil {
+		return nil, fmt.Errorf("problem retrieving the manifest of %s: %v", ref, err)
+	}
+	if len(manifest.Manifests) > 0 {
+		digest := ""
+		for _, entry := range manifest.Manifests {
+			if entry.Platform.OS == "linux" && entry.Platform.Architecture == runtime.GOARCH {
+				digest = entry.Digest
+				break
+			}
+		}
+		if len(digest) == 0 {
+			return nil, fmt.Errorf("%s has no image for linux/%s", ref, runtime.GOARCH)
+		}
+		manifest = &imageManifest{}
+		if err := session.getJSON(repositoryURL+"/manifests/"+digest, manifestMediaTypes, manifest); err != nil {
+			return nil, fmt.Errorf("problem retrieving the linux/%s manifest of %s: %v", runtime.GOARCH, ref, err)
+		}
+	}
+	if len(manifest.Config.Digest) == 0 {
+		return nil, fmt.Errorf("%s has a schema %d manifest without an image config, which is not supported", ref, manifest.SchemaVersion)
+	}
+
+	config := struct {
+		Config ImageConfig `json:"config"`
+	}{}
+	if err := session.getJSON(repositoryURL+"/blobs/"+manifest.Config.Digest, nil, &config); err != nil {
+		return nil, fmt.Errorf("problem retrieving the config of %s: %v", ref, err)
+	}
+	return &config.Config, nil
+}
+
+func newRegistryClient(caData string, insecure bool) *http.Client {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	// CA data without any certificates does not add anything to trust
+	if !pool.AppendCertsFromPEM([]byte(caData)) && !insecure {
+		return registryClient
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, InsecureSkipVerify: insecure}
+	return &http.Client{Timeout: registryClient.Timeout, Transport: transport}
+}
+
+// getJSON decodes the response to a GET request, answering a bearer challenge with a token, or a basic one with the
+// credentials, once.  Blobs are often served by redirecting elsewhere, which the http client follows without
+// passing on the authorization.
+func (s *registrySession) getJSON(url string, accept []string, into interface{}) error {
+	resp, err := s.get(url, accept)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		switch {
+		case strings.HasPrefix(strings.ToLower(challenge), "bearer "):
+			if s.token, err = getBearerToken(s.client, challenge, s.auth); err != nil {
+				return err
+			}
+		case s.auth == nil:
+			return fmt.Errorf("the registry requires credentials")
+		}
+		if resp, err = s.get(url, accept); err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response from registry: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
+
+func (s *registrySession) get(url string, accept []string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(accept) > 0 {
+		req.Header.Set("Accept", strings.Join(accept, ", "))
+	}
+	switch {
+	case len(s.token) > 0:
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	case s.auth != nil:
+		req.SetBasicAuth(s.auth.Username, s.auth.Password)
+	}
+	return s.client.Do(req)
+}
@@ -0,0 +1,53 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	tektonDir = "/tekton"
+	// TektonResultsDir is where Tekton collects the results of a step from, one file per result
+	TektonResultsDir = "/tekton/results"
+	// TektonWorkspaceDir is the working directory of Tekton steps, under which workspaces are mounted
+	TektonWorkspaceDir = "/workspace"
+	// TektonServiceAccount is the service account the OpenShift Pipelines operator creates, and runs pipelines with,
+	// in each namespace
+	TektonServiceAccount = "pipeline"
+)
+
+// GetPodNamespace returns the namespace of the pod obu is running in, from either the downward API or the mounted
+// service account, or "" when not running in a pod.
+func GetPodNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); len(namespace) > 0 {
+		return namespace
+	}
+	data, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// IsTekton returns true when obu is running as a step of a Tekton TaskRun, based on the directories and environment
+// the Tekton entrypoint sets up for every step.
+func IsTekton() bool {
+	if strings.HasPrefix(os.Getenv("HOME"), tektonDir+"/") {
+		return true
+	}
+	info, err := os.Stat(tektonDir)
+	return err == nil && info.IsDir()
+}
+
+// GetTektonOutputFile resolves a relative output file against dir when running in Tekton, so that i.e. a bare result
+// name ends up where Tekton expects it; absolute paths, and any path outside of Tekton, are returned as is.
+func GetTektonOutputFile(path, dir string) string {
+	if len(path) == 0 || filepath.IsAbs(path) || !IsTekton() {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
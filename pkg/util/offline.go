@@ -0,0 +1,194 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gabemontero/obu/pkg/api"
+	buildfake "github.com/openshift/client-go/build/clientset/versioned/fake"
+	configfake "github.com/openshift/client-go/config/clientset/versioned/fake"
+	imagefake "github.com/openshift/client-go/image/clientset/versioned/fake"
+	operatorfake "github.com/openshift/client-go/operator/clientset/versioned/fake"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+var (
+	kubeScheme     = runtime.NewScheme()
+	buildScheme    = runtime.NewScheme()
+	configScheme   = runtime.NewScheme()
+	imageScheme    = runtime.NewScheme()
+	operatorScheme = runtime.NewScheme()
+	manifestScheme = runtime.NewScheme()
+	manifestCodecs = serializer.NewCodecFactory(manifestScheme)
+)
+
+func init() {
+	utilruntime.Must(kubefake.AddToScheme(kubeScheme))
+	utilruntime.Must(buildfake.AddToScheme(buildScheme))
+	utilruntime.Must(configfake.AddToScheme(configScheme))
+	utilruntime.Must(imagefake.AddToScheme(imageScheme))
+	utilruntime.Must(operatorfake.AddToScheme(operatorScheme))
+
+	utilruntime.Must(kubefake.AddToScheme(manifestScheme))
+	utilruntime.Must(buildfake.AddToScheme(manifestScheme))
+	utilruntime.Must(configfake.AddToScheme(manifestScheme))
+	utilruntime.Must(imagefake.AddToScheme(manifestScheme))
+	utilruntime.Must(operatorfake.AddToScheme(manifestScheme))
+}
+
+// IsOffline returns true when obu has been pointed at exported manifests instead of a live cluster.
+func IsOffline(cfg *api.Config) bool {
+	return len(cfg.FromDir) > 0 || len(cfg.FromFiles) > 0
+}
+
+// GetOfflineClients loads the manifests referenced by --from-dir and --from-file and seeds in memory object trackers
+// with them, so that the obu commands can run against the same client interfaces they use with a live cluster.
+func GetOfflineClients(cfg *api.Config) (*Clients, error) {
+	objs := []runtime.Object{}
+	if len(cfg.FromDir) > 0 {
+		err := filepath.Walk(cfg.FromDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !isManifestFile(path) {
+				return nil
+			}
+			fileObjs, err := loadManifestFile(path)
+			if err != nil {
+				// directories like must-gather dumps have plenty of content we do not care about, so just warn
+				fmt.Fprintf(os.Stderr, "WARNING: skipping %s: %v\n", path, err)
+				return nil
+			}
+			objs = append(objs, fileObjs...)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("problem walking manifest directory %s: %v", cfg.FromDir, err)
+		}
+	}
+	for _, path := range cfg.FromFiles {
+		fileObjs, err := loadManifestFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("problem loading manifest file %s: %v", path, err)
+		}
+		objs = append(objs, fileObjs...)
+	}
+
+	kubeObjs := []runtime.Object{}
+	buildObjs := []runtime.Object{}
+	configObjs := []runtime.Object{}
+	imageObjs := []runtime.Object{}
+	operatorObjs := []runtime.Object{}
+	for _, obj := range objs {
+		gvk := obj.GetObjectKind().GroupVersionKind()
+		switch {
+		case kubeScheme.Recognizes(gvk):
+			kubeObjs = append(kubeObjs, obj)
+		case buildScheme.Recognizes(gvk):
+			buildObjs = append(buildObjs, obj)
+		case configScheme.Recognizes(gvk):
+			configObjs = append(configObjs, obj)
+		case imageScheme.Recognizes(gvk):
+			imageObjs = append(imageObjs, obj)
+		case operatorScheme.Recognizes(gvk):
+			operatorObjs = append(operatorObjs, obj)
+		}
+	}
+
+	return &Clients{
+		Core:     kubefake.NewSimpleClientset(kubeObjs...),
+		Build:    buildfake.NewSimpleClientset(buildObjs...),
+		Config:   configfake.NewSimpleClientset(configObjs...),
+		Image:    imagefake.NewSimpleClientset(imageObjs...),
+		Operator: operatorfake.NewSimpleClientset(operatorObjs...),
+		// resources only reached through the dynamic client, like Tekton's, are not loaded from disk
+		Dynamic: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()),
+	}, nil
+}
+
+func isManifestFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// loadManifestFile decodes every YAML or JSON document in a file, expanding any lists (i.e. 'oc get -o yaml' output)
+// into their items.  Documents with types obu does not know about are ignored.
+func loadManifestFile(path string) ([]runtime.Object, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	objs := []runtime.Object{}
+	reader := yaml.NewYAMLReader(bufio.NewReader(f))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		docObjs, err := decodeManifest(doc)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, docObjs...)
+	}
+	return objs, nil
+}
+
+func decodeManifest(data []byte) ([]runtime.Object, error) {
+	obj, _, err := manifestCodecs.UniversalDeserializer().Decode(data, nil, nil)
+	if runtime.IsNotRegisteredError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !meta.IsListType(obj) {
+		return []runtime.Object{obj}, nil
+	}
+	items, err := meta.ExtractList(obj)
+	if err != nil {
+		return nil, err
+	}
+	listGVK := obj.GetObjectKind().GroupVersionKind()
+	objs := []runtime.Object{}
+	for _, item := range items {
+		// generic v1 Lists hold their items as raw bytes
+		if unknown, ok := item.(*runtime.Unknown); ok {
+			itemObjs, err := decodeManifest(unknown.Raw)
+			if err != nil {
+				return nil, err
+			}
+			objs = append(objs, itemObjs...)
+			continue
+		}
+		// whereas typed lists like ProxyList do not always repeat the type info on each item
+		if item.GetObjectKind().GroupVersionKind().Empty() {
+			item.GetObjectKind().SetGroupVersionKind(listGVK.GroupVersion().WithKind(strings.TrimSuffix(listGVK.Kind, "List")))
+		}
+		objs = append(objs, item)
+	}
+	return objs, nil
+}
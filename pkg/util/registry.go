@@ -0,0 +1,169 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/openshift/library-go/pkg/image/reference"
+)
+
+// ImageStatus is the outcome of asking a registry whether it can serve an image manifest.
+type ImageStatus string
+
+const (
+	ImageAvailable    ImageStatus = "available"
+	ImageAuthRequired ImageStatus = "authentication required"
+	ImageNotFound     ImageStatus = "not found"
+	ImageUnreachable  ImageStatus = "unreachable"
+)
+
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+var challengeParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+var registryClient = &http.Client{Timeout: 30 * time.Second}
+
+// ProbeImage checks, anonymously, whether the registry hosting the image reference can serve its manifest.  A
+// registry that requires credentials is reported as such rather than as unavailable, since the build tool may
+// very well have those credentials.
+func ProbeImage(ref string) (ImageStatus, error) {
+	resp, err := headManifest(ref)
+	if err != nil {
+		return ImageUnreachable, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return ImageAvailable, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return ImageAuthRequired, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return ImageNotFound, nil
+	}
+	return ImageUnreachable, fmt.Errorf("unexpected response from registry for %s: %s", ref, resp.Status)
+}
+
+// ResolveDigest replaces the tag of an image reference with the digest of the manifest the registry serves for it.
+func ResolveDigest(ref string) (string, error) {
+	parsed, err := reference.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	if len(parsed.ID) > 0 {
+		return ref, nil
+	}
+	resp, err := headManifest(ref)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to resolve the digest for %s: %s", ref, resp.Status)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if len(digest) == 0 {
+		return "", fmt.Errorf("registry did not provide a digest for %s", ref)
+	}
+	parsed.Tag = ""
+	parsed.ID = digest
+	return parsed.Exact(), nil
+}
+
+func headManifest(ref string) (*http.Response, error) {
+	parsed, err := reference.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	parsed = parsed.DockerClientDefaults().AsV2()
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", parsed.Registry, parsed.RepositoryName(), parsed.ID)
+	if len(parsed.ID) == 0 {
+		manifestURL = fmt.Sprintf("https://%s/v2/%s/manifests/%s", parsed.Registry, parsed.RepositoryName(), parsed.Tag)
+	}
+
+	resp, err := doManifestRequest(manifestURL, "")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	// most public registries hand out anonymous bearer tokens for pulls, so make a second attempt with one of those
+	token, err := getBearerToken(registryClient, resp.Header.Get("WWW-Authenticate"), nil)
+	if err != nil || len(token) == 0 {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return doManifestRequest(manifestURL, token)
+}
+
+func doManifestRequest(manifestURL, token string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return registryClient.Do(req)
+}
+
+// getBearerToken requests a token for the scope of a bearer challenge, anonymously unless credentials are given
+func getBearerToken(client *http.Client, challenge string, auth *RegistryAuth) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return "", nil
+	}
+	params := map[string]string{}
+	for _, match := range challengeParamRegex.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+	realm, exists := params["realm"]
+	if !exists {
+		return "", nil
+	}
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	query := tokenURL.Query()
+	for _, key := range []string{"service", "scope"} {
+		if value, exists := params[key]; exists {
+			query.Set(key, value)
+		}
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if auth != nil {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil
+	}
+	tokenResponse := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return "", err
+	}
+	if len(tokenResponse.Token) > 0 {
+		return tokenResponse.Token, nil
+	}
+	return tokenResponse.AccessToken, nil
+}
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	setupSignalHandlerOnce sync.Once
+	signalStop             chan struct{}
+)
+
+// SetupSignalHandler returns a channel that is closed when obu is asked to terminate, so that long running verbs
+// can shut down cleanly.  A second signal exits immediately.
+func SetupSignalHandler() <-chan struct{} {
+	setupSignalHandlerOnce.Do(func() {
+		signalStop = make(chan struct{})
+		c := make(chan os.Signal, 2)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-c
+			close(signalStop)
+			<-c
+			os.Exit(1)
+		}()
+	})
+	return signalStop
+}
+
+// SignalContext returns a context that is cancelled when obu is asked to terminate, which also aborts any API
+// server requests in flight.
+func SignalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := SetupSignalHandler()
+	go func() {
+		<-stop
+		cancel()
+	}()
+	return ctx
+}
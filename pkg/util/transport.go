@@ -0,0 +1,133 @@
+package util
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// the backoff between attempts of a request that failed with a transient error, adding up to about 15 seconds
+var retryBackoff = wait.Backoff{
+	Duration: 500 * time.Millisecond,
+	Factor:   2.0,
+	Jitter:   0.1,
+	Steps:    5,
+}
+
+// retryingRoundTripper retries API server requests that fail with transient errors, and applies the request timeout
+// to each attempt.  All attempts are tied to the context that is cancelled when obu is asked to terminate.
+type retryingRoundTripper struct {
+	delegate http.RoundTripper
+	timeout  time.Duration
+	ctx      context.Context
+}
+
+func newRetryingRoundTripper(delegate http.RoundTripper, timeout time.Duration) http.RoundTripper {
+	return &retryingRoundTripper{delegate: delegate, timeout: timeout, ctx: SignalContext()}
+}
+
+func (rt *retryingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a request body can only be sent again if it can be recreated
+	retryable := req.Body == nil || req.GetBody != nil
+	backoff := retryBackoff
+	for {
+		resp, err := rt.roundTripOnce(req)
+		if !retryable || backoff.Steps <= 1 || !isRetryableError(req, resp, err) {
+			return resp, err
+		}
+		delay := backoff.Step()
+		if resp != nil {
+			if retryAfter := getRetryAfter(resp); retryAfter > delay {
+				delay = retryAfter
+			}
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-rt.ctx.Done():
+			return nil, rt.ctx.Err()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+func (rt *retryingRoundTripper) roundTripOnce(req *http.Request) (*http.Response, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	// watches are expected to stay open, so only bound the rest of the requests
+	if rt.timeout > 0 && req.URL.Query().Get("watch") != "true" {
+		ctx, cancel = context.WithTimeout(req.Context(), rt.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(req.Context())
+	}
+	go func() {
+		select {
+		case <-rt.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	resp, err := rt.delegate.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the response body is still being read after RoundTrip returns, so the timeout and cancellation have to stay
+	// in effect until it is closed
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// isRetryableError only lets requests that could have had an effect on the server be sent again when they are
+// idempotent.  Other requests, like creates, are only retried when the server has turned them away before
+// processing them and asked for them to be sent again later.
+func isRetryableError(req *http.Request, resp *http.Response, err error) bool {
+	if !isTransientError(resp, err) {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) &&
+		getRetryAfter(resp) > 0
+}
+
+func isTransientError(resp *http.Response, err error) bool {
+	if err != nil {
+		return utilnet.IsConnectionReset(err) || utilnet.IsProbableEOF(err)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+func getRetryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
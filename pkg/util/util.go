@@ -11,3 +11,16 @@ func DefaultMessage() {
 	fmt.Fprintf(os.Stdout, "variables that can be subsequently consumed by your image\n")
 	fmt.Fprintf(os.Stdout, "build tool.\n")
 }
+
+// IsRegularFile returns true when f, i.e. os.Stdout, has been redirected to a file, as opposed to a terminal or a pipe
+// like the one a container's output is logged through.
+func IsRegularFile(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode().IsRegular()
+}
+
+// IsTerminal returns true when f is a character device, which for the standard streams means a terminal.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}